@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"path"
+	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/joho/godotenv"
 
 	"mysql-exporter/internal/config"
@@ -12,6 +22,8 @@ import (
 	"mysql-exporter/internal/reactor/hub"
 	middleware "mysql-exporter/internal/reactor/middleware"
 	"mysql-exporter/internal/reactor/store"
+	"mysql-exporter/internal/storage"
+	"mysql-exporter/internal/tunnel"
 )
 
 func main() {
@@ -46,13 +58,27 @@ func main() {
 	// 3. Initialize Hub (WebSocket Manager)
 	h := hub.NewHub()
 
-	// 4. Initialize Handlers
-	handler := api.NewHandler(st, h, cfg.APISecret)
+	// 4. Initialize Storage (exports of agent jobs)
+	sp, err := newStorage(cfg)
+	if err != nil {
+		slog.Error("Failed to initialize storage", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Storage Initialized", "type", cfg.StorageType)
 
-	// 5. Setup Routes & Middleware
+	// 5. Initialize Handlers
+	handler := api.NewHandler(st, h, cfg.APISecret, sp, cfg.ConfigCompression)
+	handler.AgentVersion = cfg.AgentVersion
+	handler.RequireAgentCert = cfg.AgentRequireCert
+	handler.Tunnels = tunnel.NewServer()
+
+	// 6. Setup Routes & Middleware
 	mux := http.NewServeMux()
 	mux.HandleFunc("/agent/control", handler.HandleControl)
 	mux.HandleFunc("/agent/data", handler.HandleData)
+	mux.HandleFunc("/agent/check", handler.HandleAgentCheck)
+	mux.HandleFunc("POST /agent/tunnel", handler.HandleTunnelOpen)
+	mux.HandleFunc("/agent/tunnel/{id}", handler.HandleTunnel)
 	mux.HandleFunc("/dashboard/stream", handler.HandleDashboard)
 	mux.HandleFunc("/auth/register", handler.HandleRegister)
 	mux.HandleFunc("/auth/verify", handler.HandleVerify)
@@ -62,12 +88,114 @@ func main() {
 	mux.Handle("/auth/keys/create", authMiddleware(http.HandlerFunc(handler.HandleCreateKey)))
 	mux.Handle("/auth/keys/list", authMiddleware(http.HandlerFunc(handler.HandleListKeys)))
 	mux.Handle("/auth/keys/revoke", authMiddleware(http.HandlerFunc(handler.HandleRevokeKey)))
+	mux.Handle("GET /agents", authMiddleware(http.HandlerFunc(handler.HandleListAgents)))
+	mux.Handle("POST /jobs", authMiddleware(http.HandlerFunc(handler.HandleCreateJob)))
+	mux.Handle("GET /jobs", authMiddleware(http.HandlerFunc(handler.HandleListJobs)))
+	mux.Handle("GET /jobs/{id}", authMiddleware(http.HandlerFunc(handler.HandleGetJob)))
+	mux.Handle("POST /jobs/{id}/cancel", authMiddleware(http.HandlerFunc(handler.HandleCancelJob)))
 
 	// Wrap with Middleware
 	finalHandler := middleware.CORS(cfg.AllowedOrigins, cfg.AppEnv)(mux)
 
-	slog.Info("Reactor listening", "port", cfg.ServerPort)
-	if err := http.ListenAndServe(":"+cfg.ServerPort, finalHandler); err != nil {
+	// Connections tunnelled over HTTP long-polling are served like direct ones,
+	// except that they cannot open tunnels in turn
+	tunnelServer := &http.Server{Handler: withoutTunnels(finalHandler), ConnContext: tunnel.ConnContext}
+	go tunnelServer.Serve(handler.Tunnels)
+
+	server := &http.Server{Addr: ":" + cfg.ServerPort, Handler: finalHandler}
+	if cfg.TLSCertFile == "" {
+		if cfg.AgentClientCAFile != "" || cfg.AgentRequireCert {
+			slog.Error("Agent client certificates require TLS_CERT_FILE and TLS_KEY_FILE")
+			os.Exit(1)
+		}
+		slog.Info("Reactor listening", "port", cfg.ServerPort)
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig, err = serverTLSConfig(cfg)
+		if err != nil {
+			slog.Error("Invalid TLS configuration", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Reactor listening (TLS)", "port", cfg.ServerPort, "agent_client_certs", cfg.AgentClientCAFile != "", "require_client_cert", cfg.AgentRequireCert)
+		err = server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	if err != nil {
 		slog.Error("Server failed", "error", err)
 	}
 }
+
+// serverTLSConfig verifies the client certificates agents present against the
+// agent CA, if one is configured. Browsers and API clients present none, so
+// certificates stay optional at the TLS level; agent handlers decide whether
+// they need one.
+func serverTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.AgentClientCAFile == "" {
+		if cfg.AgentRequireCert {
+			return nil, fmt.Errorf("AGENT_REQUIRE_CLIENT_CERT needs AGENT_CLIENT_CA_FILE")
+		}
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.AgentClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", cfg.AgentClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+// newStorage creates the storage provider selected by STORAGE_TYPE.
+func newStorage(cfg *config.Config) (storage.Provider, error) {
+	switch cfg.StorageType {
+	case "local":
+		return storage.NewLocalProvider(cfg.LocalStoragePath), nil
+	case "s3":
+		// The default chain finds IAM roles, instance profiles and shared
+		// config; static keys, if set, take precedence
+		opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(cfg.AWSRegion)}
+		if cfg.AWSAccessKeyID != "" || cfg.AWSSecretAccessKey != "" {
+			if cfg.AWSAccessKeyID == "" || cfg.AWSSecretAccessKey == "" {
+				return nil, fmt.Errorf("set both AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or neither")
+			}
+			opts = append(opts, awsconfig.WithCredentialsProvider(
+				credentials.NewStaticCredentialsProvider(cfg.AWSAccessKeyID, cfg.AWSSecretAccessKey, "")))
+		}
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("load AWS configuration: %w", err)
+		}
+		client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+			o.UsePathStyle = cfg.S3PathStyle
+			o.BaseEndpoint = nilIfEmpty(cfg.S3Endpoint)
+		})
+		return storage.NewS3Provider(client, cfg.S3Bucket), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_TYPE %q (want local or s3)", cfg.StorageType)
+	}
+}
+
+// withoutTunnels hides the tunnel endpoints from connections made through a
+// tunnel, so tunnels cannot be nested.
+func withoutTunnels(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean(r.URL.Path)
+		if p == "/agent/tunnel" || strings.HasPrefix(p, "/agent/tunnel/") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
@@ -0,0 +1,587 @@
+// Package agent runs jobs dispatched by the Reactor against a local database
+// and streams the results back over the data channel.
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+	"mysql-exporter/internal/tunnel"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/semaphore"
+)
+
+// Config holds the settings an agent needs to talk to the Reactor.
+type Config struct {
+	// ReactorURL is the WebSocket base URL of the Reactor (e.g., wss://api.fluxquery.com).
+	ReactorURL string
+	// AgentKey is the API key the agent authenticates with.
+	AgentKey string
+	// Version is the agent build version reported to the Reactor.
+	Version string
+	// MaxJobs is the number of jobs allowed to query the database at once.
+	MaxJobs int
+	// QueueSize is the number of jobs allowed to wait for a free slot.
+	// Jobs beyond that are rejected so the Reactor can route them elsewhere.
+	QueueSize int
+	// BatchRows and BatchBytes bound each row batch frame; a batch is sent as
+	// soon as either is reached. BatchBytes is estimated from the row values.
+	BatchRows  int
+	BatchBytes int
+	// Compression is the preferred data stream compression: "zstd", "gzip" or
+	// "none". The Reactor may pick a different one during the handshake.
+	Compression string
+	// TLS configures connections to the Reactor; nil uses the system defaults.
+	TLS *tls.Config
+	// Proxy picks the HTTP proxy for connections to the Reactor; nil uses
+	// HTTPS_PROXY and NO_PROXY from the environment.
+	Proxy func(*http.Request) (*url.URL, error)
+	// Transport is how the agent connects to the Reactor: TransportWebSocket,
+	// TransportPoll, or TransportAuto (the default).
+	Transport string
+	// Spool keeps the data streams of jobs on disk, so they can be uploaded
+	// later if the Reactor becomes unreachable mid-job. nil disables it.
+	Spool *Spool
+	// OnUpdate is called with the release the Reactor advertises, if it
+	// differs from Version. It must not block; nil only logs the release.
+	OnUpdate func(version string)
+}
+
+// Transports to the Reactor.
+const (
+	// TransportAuto uses WebSocket connections, and switches to HTTP
+	// long-polling for good if they fail while a tunnel works.
+	TransportAuto = "auto"
+	// TransportWebSocket only uses WebSocket connections.
+	TransportWebSocket = "websocket"
+	// TransportPoll tunnels the WebSocket connections through HTTP
+	// long-polling, for networks whose proxies block WebSocket upgrades.
+	TransportPoll = "poll"
+)
+
+const (
+	defaultMaxJobs    = 4
+	defaultQueueSize  = 16
+	defaultBatchRows  = 1000
+	defaultBatchBytes = 1 << 20
+)
+
+// Agent tracks the jobs it is running so they can be cancelled by the Reactor.
+type Agent struct {
+	sources    []Source // the first one is the default
+	reactorURL string
+	agentKey   string
+	version    string
+	tlsConfig  *tls.Config
+	proxy      func(*http.Request) (*url.URL, error)
+
+	transport    string
+	tunneling    atomic.Bool  // TransportAuto switched to tunnels
+	tunnelURL    string       // where tunnels are opened
+	innerURL     string       // base URL of connections through a tunnel
+	tunnelClient *http.Client // carries the tunnel requests
+
+	// jobSem limits concurrent queries against the customer database,
+	// the same way worker.Pool guards its DB connections.
+	jobSem    *semaphore.Weighted
+	maxJobs   int
+	queueSize int
+
+	batchRows   int
+	batchBytes  int
+	compression []string // offered to the Reactor, in order of preference
+	spool       *Spool
+	onUpdate    func(version string)
+
+	connected     chan struct{} // closed once the agent first announced itself
+	connectedOnce sync.Once
+
+	// draining is done once Shutdown starts; queued jobs stop waiting for a slot
+	draining     context.Context
+	startDrain   context.CancelFunc
+	jobsFinished sync.WaitGroup
+
+	mu      sync.Mutex
+	jobs    map[string]context.CancelCauseFunc
+	running int
+	queued  int
+	ctrl    *controlConn // current control connection, nil while disconnected
+}
+
+// New creates an agent that executes queries on the given sources and streams
+// the results to the Reactor. sources must not be empty; the first one is used
+// for jobs that do not name a source.
+func New(cfg Config, sources []Source) *Agent {
+	if cfg.MaxJobs <= 0 {
+		cfg.MaxJobs = defaultMaxJobs
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	if cfg.BatchRows <= 0 {
+		cfg.BatchRows = defaultBatchRows
+	}
+	if cfg.BatchBytes <= 0 {
+		cfg.BatchBytes = defaultBatchBytes
+	}
+
+	var compression []string
+	switch cfg.Compression {
+	case "none":
+	case protocol.CompressionGzip:
+		compression = []string{protocol.CompressionGzip}
+	default:
+		compression = []string{protocol.CompressionZstd, protocol.CompressionGzip}
+	}
+
+	if cfg.Transport == "" {
+		cfg.Transport = TransportAuto
+	}
+	proxy := cfg.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	tunnelURL, innerURL := tunnelURLs(cfg.ReactorURL)
+	tunnelClient := &http.Client{Transport: &http.Transport{
+		Proxy:               proxy,
+		TLSClientConfig:     cfg.TLS,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}}
+
+	draining, startDrain := context.WithCancel(context.Background())
+	return &Agent{
+		sources:      sources,
+		reactorURL:   cfg.ReactorURL,
+		agentKey:     cfg.AgentKey,
+		tlsConfig:    cfg.TLS,
+		proxy:        proxy,
+		transport:    cfg.Transport,
+		tunnelURL:    tunnelURL,
+		innerURL:     innerURL,
+		tunnelClient: tunnelClient,
+		version:      cfg.Version,
+		jobSem:       semaphore.NewWeighted(int64(cfg.MaxJobs)),
+		maxJobs:      cfg.MaxJobs,
+		queueSize:    cfg.QueueSize,
+		batchRows:    cfg.BatchRows,
+		batchBytes:   cfg.BatchBytes,
+		compression:  compression,
+		spool:        cfg.Spool,
+		onUpdate:     cfg.OnUpdate,
+		connected:    make(chan struct{}),
+		draining:     draining,
+		startDrain:   startDrain,
+		jobs:         make(map[string]context.CancelCauseFunc),
+	}
+}
+
+const (
+	// reconnectMin and reconnectMax bound the delay between control-plane reconnects.
+	reconnectMin = 1 * time.Second
+	reconnectMax = 60 * time.Second
+)
+
+// Run keeps the agent connected to the Reactor control plane until ctx is done,
+// reconnecting with jittered exponential backoff whenever the connection drops.
+// Running jobs are not affected by reconnects: each has its own data connection.
+func (a *Agent) Run(ctx context.Context) error {
+	bo := newBackoff(reconnectMin, reconnectMax)
+	for {
+		conn, err := a.dial(ctx, "/agent/control")
+		if err != nil {
+			delay := bo.Next()
+			slog.Error("Failed to connect to Reactor Control Plane", "error", err, "retry_in", delay.String())
+			if !sleep(ctx, delay) {
+				return ctx.Err()
+			}
+			continue
+		}
+		slog.Info("Connected to Reactor Control Plane")
+		connectedAt := time.Now()
+
+		// Unblock Serve when shutting down
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		err = a.Serve(conn)
+		stop()
+		conn.Close()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Only start over from the shortest delay if the connection was stable,
+		// otherwise a Reactor that accepts and immediately drops us gets hammered.
+		if time.Since(connectedAt) > reconnectMax {
+			bo.Reset()
+		}
+		delay := bo.Next()
+		slog.Warn("Lost connection to Reactor Control Plane", "error", err, "retry_in", delay.String())
+		if !sleep(ctx, delay) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Connected is closed once the agent has announced itself to the Reactor for
+// the first time.
+func (a *Agent) Connected() <-chan struct{} {
+	return a.connected
+}
+
+// shutdownGracePeriod is how long jobs cancelled by Shutdown get to report
+// the failure to the Reactor before it returns.
+const shutdownGracePeriod = 10 * time.Second
+
+// errShuttingDown is the cause of a job context cancelled by Shutdown.
+var errShuttingDown = errors.New("agent shut down before the job finished")
+
+// Shutdown drains the agent: it rejects new jobs, tells the Reactor so it
+// stops sending them, rejects the queued ones and waits for the running ones
+// to finish their data stream. Jobs still running when ctx is done are
+// cancelled and fail with ErrorClassShutdown.
+//
+// Run must keep going while Shutdown waits, so the control connection can
+// carry the job statuses; stop it once Shutdown returns.
+func (a *Agent) Shutdown(ctx context.Context) error {
+	// Under the lock, so schedule either tracked a job before or rejects it
+	a.mu.Lock()
+	a.startDrain()
+	a.mu.Unlock()
+
+	load := a.load()
+	slog.Info("Draining jobs", "running", load.RunningJobs, "queued", load.QueuedJobs)
+	a.notify(protocol.ControlMessage{Type: protocol.TypeDraining, Load: load})
+
+	finished := make(chan struct{})
+	go func() {
+		a.jobsFinished.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+
+	a.mu.Lock()
+	slog.Warn("Drain deadline reached, cancelling jobs", "jobs", len(a.jobs))
+	for _, cancel := range a.jobs {
+		cancel(errShuttingDown)
+	}
+	a.mu.Unlock()
+
+	select {
+	case <-finished:
+	case <-time.After(shutdownGracePeriod):
+	}
+	return ctx.Err()
+}
+
+// dial opens an authenticated WebSocket connection to the given Reactor path,
+// offering the given subprotocols, if any.
+func (a *Agent) dial(ctx context.Context, path string, subprotocols ...string) (*websocket.Conn, error) {
+	conn, _, err := a.dialResponse(ctx, path, subprotocols...)
+	return conn, err
+}
+
+// dialResponse is dial, also returning the HTTP response, e.g. to tell a
+// refused upgrade from an unreachable Reactor.
+func (a *Agent) dialResponse(ctx context.Context, path string, subprotocols ...string) (*websocket.Conn, *http.Response, error) {
+	if a.transport == TransportPoll || a.tunneling.Load() {
+		return a.dialTunnel(ctx, path, subprotocols...)
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = subprotocols
+	dialer.TLSClientConfig = a.tlsConfig
+	dialer.Proxy = a.proxy
+
+	conn, resp, err := dialer.DialContext(ctx, a.reactorURL+path, a.headers())
+	if err == nil || a.transport != TransportAuto || ctx.Err() != nil {
+		return conn, resp, err
+	}
+
+	// Whatever stopped the upgrade, a tunnel tells whether it is in the way
+	tconn, tresp, terr := a.dialTunnel(ctx, path, subprotocols...)
+	if terr != nil {
+		// The WebSocket error says more, e.g. when the Reactor is down
+		return conn, resp, err
+	}
+	if a.tunneling.CompareAndSwap(false, true) {
+		slog.Warn("WebSocket connection to Reactor failed, switching to HTTP long-polling", "error", err)
+	}
+	return tconn, tresp, nil
+}
+
+// dialTunnel opens a tunnel and connects to the given Reactor path through it.
+// The tunnel requests are encrypted, so the handshake inside it is not.
+func (a *Agent) dialTunnel(ctx context.Context, path string, subprotocols ...string) (*websocket.Conn, *http.Response, error) {
+	headers := a.headers()
+	dialer := websocket.Dialer{
+		Subprotocols:     subprotocols,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		NetDialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return tunnel.Dial(ctx, a.tunnelClient, a.tunnelURL, headers)
+		},
+	}
+	return dialer.DialContext(ctx, a.innerURL+path, headers)
+}
+
+func (a *Agent) headers() http.Header {
+	return http.Header{"X-Agent-Key": []string{a.agentKey}}
+}
+
+// tunnelURLs returns the URL tunnels to the Reactor at reactorURL are opened
+// at, and the base URL of the connections made through them.
+func tunnelURLs(reactorURL string) (tunnelURL, innerURL string) {
+	if rest, ok := strings.CutPrefix(reactorURL, "wss://"); ok {
+		return "https://" + rest + "/agent/tunnel", "ws://" + rest
+	}
+	if rest, ok := strings.CutPrefix(reactorURL, "ws://"); ok {
+		return "http://" + rest + "/agent/tunnel", reactorURL
+	}
+	return reactorURL + "/agent/tunnel", reactorURL
+}
+
+// Serve announces the agent on the control connection, then reads commands until
+// it fails. The Reactor pings regularly, so a silent connection hits the read
+// deadline instead of hanging forever.
+func (a *Agent) Serve(conn *websocket.Conn) error {
+	ctrl := &controlConn{conn: conn}
+	a.setControl(ctrl)
+	defer a.setControl(nil)
+
+	hostname, _ := os.Hostname()
+	if err := ctrl.Send(protocol.ControlMessage{
+		Type:     protocol.TypeHello,
+		Driver:   a.sources[0].Driver.Name(),
+		Version:  a.version,
+		Hostname: hostname,
+		Sources:  a.sourceInfo(),
+	}); err != nil {
+		return err
+	}
+	a.connectedOnce.Do(func() { close(a.connected) })
+	if a.draining.Err() != nil {
+		if err := ctrl.Send(protocol.ControlMessage{Type: protocol.TypeDraining, Load: a.load()}); err != nil {
+			return err
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(protocol.PongWait))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(protocol.PongWait))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go a.heartbeatLoop(ctrl, done)
+	if a.spool != nil {
+		go a.spoolLoop(done)
+	}
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(protocol.PongWait))
+
+		var msg protocol.ControlMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			slog.Error("Invalid command", "error", err)
+			continue
+		}
+
+		a.handleMessage(msg)
+	}
+}
+
+func (a *Agent) handleMessage(msg protocol.ControlMessage) {
+	switch msg.Type {
+	case protocol.TypeJob, "": // Reactors before the typed protocol only sent jobs
+		slog.Info("Received Job", "id", msg.JobID, "source", msg.Source, "query", msg.Query)
+		a.schedule(msg.JobID, msg.Source, msg.Query)
+	case protocol.TypeCancel:
+		a.cancel(msg.JobID)
+	case protocol.TypeUpdate:
+		if msg.Version == a.version {
+			return
+		}
+		slog.Info("Agent update available", "version", msg.Version, "running", a.version)
+		if a.onUpdate != nil {
+			a.onUpdate(msg.Version)
+		}
+	default:
+		slog.Warn("Unknown command", "type", msg.Type)
+	}
+}
+
+// schedule starts the job if a slot is free, queues it if the queue has room,
+// and otherwise rejects it. Jobs for unknown sources or that violate the
+// source's policy are rejected as well.
+// Every outcome is reported to the Reactor.
+func (a *Agent) schedule(jobID, sourceName, query string) {
+	src, ok := a.source(sourceName)
+	if !ok {
+		slog.Warn("Rejecting job for unknown source", "id", jobID, "source", sourceName)
+		a.notify(protocol.ControlMessage{Type: protocol.TypeJobStatus, JobID: jobID, Status: protocol.JobRejected, Reason: fmt.Sprintf("unknown source %q", sourceName), Load: a.load()})
+		return
+	}
+	if err := src.Policy.Check(src.Driver.Name(), query); err != nil {
+		slog.Warn("Rejecting job, query violates policy", "id", jobID, "source", src.Name, "error", err)
+		a.notify(protocol.ControlMessage{Type: protocol.TypeJobStatus, JobID: jobID, Status: protocol.JobRejected, Reason: "policy: " + err.Error(), Load: a.load()})
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	a.mu.Lock()
+	if _, exists := a.jobs[jobID]; exists {
+		a.mu.Unlock()
+		cancel(nil)
+		slog.Warn("Ignoring duplicate job", "id", jobID)
+		return
+	}
+	if a.draining.Err() != nil {
+		a.mu.Unlock()
+		cancel(nil)
+		slog.Warn("Rejecting job, agent shutting down", "id", jobID)
+		a.notify(protocol.ControlMessage{Type: protocol.TypeJobStatus, JobID: jobID, Status: protocol.JobRejected, Reason: "agent shutting down", Load: a.load()})
+		return
+	}
+
+	status := protocol.JobStarted
+	switch {
+	case a.jobSem.TryAcquire(1):
+		a.running++
+	case a.queued < a.queueSize:
+		a.queued++
+		status = protocol.JobQueued
+	default:
+		a.mu.Unlock()
+		cancel(nil)
+		slog.Warn("Rejecting job, agent at capacity", "id", jobID, "running", a.maxJobs, "queued", a.queueSize)
+		a.notify(protocol.ControlMessage{Type: protocol.TypeJobStatus, JobID: jobID, Status: protocol.JobRejected, Reason: "agent busy", Load: a.load()})
+		return
+	}
+	a.jobs[jobID] = cancel
+	a.jobsFinished.Add(1)
+	a.mu.Unlock()
+
+	a.notify(protocol.ControlMessage{Type: protocol.TypeJobStatus, JobID: jobID, Status: status, Load: a.load()})
+
+	go func() {
+		defer a.jobsFinished.Done()
+		defer a.untrack(jobID)
+
+		if status == protocol.JobQueued {
+			slog.Info("Job Queued", "id", jobID)
+			err := a.acquireSlot(ctx)
+
+			a.mu.Lock()
+			a.queued--
+			if err == nil {
+				a.running++
+			}
+			a.mu.Unlock()
+
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("Rejecting queued job, agent shutting down", "id", jobID)
+				a.notify(protocol.ControlMessage{Type: protocol.TypeJobStatus, JobID: jobID, Status: protocol.JobRejected, Reason: "agent shutting down", Load: a.load()})
+				return
+			}
+			if err != nil {
+				slog.Info("Queued Job Cancelled", "id", jobID)
+				return
+			}
+			a.notify(protocol.ControlMessage{Type: protocol.TypeJobStatus, JobID: jobID, Status: protocol.JobStarted, Load: a.load()})
+		}
+
+		defer func() {
+			a.mu.Lock()
+			a.running--
+			a.mu.Unlock()
+			a.jobSem.Release(1)
+		}()
+		a.executeJob(ctx, jobID, src, query)
+	}()
+}
+
+func (a *Agent) untrack(jobID string) {
+	a.mu.Lock()
+	cancel, ok := a.jobs[jobID]
+	delete(a.jobs, jobID)
+	a.mu.Unlock()
+
+	if ok {
+		cancel(nil) // release context resources
+	}
+}
+
+// acquireSlot waits for a free job slot until ctx is done or the agent starts
+// draining, as queued jobs would not get a slot before the shutdown deadline.
+func (a *Agent) acquireSlot(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(a.draining, cancel)
+	defer stop()
+	return a.jobSem.Acquire(ctx, 1)
+}
+
+func (a *Agent) cancel(jobID string) {
+	a.mu.Lock()
+	cancel, ok := a.jobs[jobID]
+	a.mu.Unlock()
+
+	if !ok {
+		slog.Warn("Cancel for unknown job", "id", jobID)
+		return
+	}
+	slog.Info("Cancelling Job", "id", jobID)
+	cancel(nil)
+}
+
+func (a *Agent) setControl(ctrl *controlConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ctrl = ctrl
+}
+
+// notify sends msg on the current control connection. Messages sent while
+// disconnected are dropped; the next heartbeat carries the up-to-date load.
+func (a *Agent) notify(msg protocol.ControlMessage) {
+	a.mu.Lock()
+	ctrl := a.ctrl
+	a.mu.Unlock()
+
+	if ctrl == nil {
+		slog.Warn("Not connected to Reactor, dropping message", "type", msg.Type, "id", msg.JobID)
+		return
+	}
+	if err := ctrl.Send(msg); err != nil {
+		slog.Warn("Failed to send message to Reactor", "type", msg.Type, "id", msg.JobID, "error", err)
+	}
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// backoff computes jittered exponential delays between reconnect attempts.
+// Each delay is drawn from [d/2, d) where d doubles per attempt up to max,
+// so a fleet of agents does not reconnect in lockstep after a Reactor restart.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max}
+}
+
+// Next returns the delay before the next attempt.
+func (b *backoff) Next() time.Duration {
+	d := b.max
+	if b.attempt < 32 { // avoid overflowing the shift
+		if exp := b.min << b.attempt; exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + rand.N(d-half)
+}
+
+// Reset starts the sequence over after a successful connection.
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// sleep waits for d or until ctx is done. It reports whether the full delay elapsed.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
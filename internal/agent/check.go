@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"mysql-exporter/internal/tunnel"
+)
+
+// checkTimeout bounds each connectivity check.
+const checkTimeout = 10 * time.Second
+
+// CheckResult is the outcome of one of the checks run by Check.
+type CheckResult struct {
+	Name   string
+	Detail string // what was found, when the check passed
+	Err    error
+}
+
+// Check verifies that the agent can do its work: every source answers and lets
+// it read the tables its policy allows, and the Reactor accepts its key over
+// the configured TLS settings. It runs all checks, whatever fails.
+func (a *Agent) Check(ctx context.Context) []CheckResult {
+	var results []CheckResult
+	for _, src := range a.sources {
+		results = append(results, checkSource(ctx, src)...)
+	}
+	return append(results, a.checkReactor(ctx))
+}
+
+func checkSource(ctx context.Context, src Source) []CheckResult {
+	name := fmt.Sprintf("source %s (%s)", src.Name, src.Driver.Name())
+
+	pingCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	if err := src.Driver.Ping(pingCtx); err != nil {
+		return []CheckResult{{Name: name, Err: err}}
+	}
+	results := []CheckResult{{Name: name, Detail: "connected"}}
+
+	// Wildcard entries name no table to try, and sources without an allowlist
+	// may read anything the database user can
+	for _, table := range src.Policy.Tables {
+		if strings.HasSuffix(table, ".*") {
+			continue
+		}
+		results = append(results, CheckResult{
+			Name:   fmt.Sprintf("source %s: read %s", src.Name, table),
+			Detail: "allowed",
+			Err:    checkRead(ctx, src, table),
+		})
+	}
+	return results
+}
+
+// checkRead runs a query on table that returns no rows, or for MongoDB a find
+// whose cursor is closed before reading it.
+func checkRead(ctx context.Context, src Source, table string) error {
+	query := "SELECT * FROM " + table + " WHERE 1=0"
+	if src.Driver.Name() == "mongo" {
+		query = table + ".find({})"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	streamer, err := src.Driver.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	return streamer.Close()
+}
+
+// checkReactor connects to the Reactor's check endpoint, which authenticates
+// the agent like a control connection without replacing the control
+// connection of an agent already running with the same key. It reports how
+// the connection is secured.
+func (a *Agent) checkReactor(ctx context.Context) CheckResult {
+	result := CheckResult{Name: "reactor " + a.reactorURL}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	conn, resp, err := a.dialResponse(ctx, "/agent/check")
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("the Reactor does not support agent checks, upgrade it: %w", err)
+		}
+		result.Err = err
+		return result
+	}
+	defer conn.Close()
+
+	var state *tls.ConnectionState
+	result.Detail = "connected"
+	switch c := conn.UnderlyingConn().(type) {
+	case *tls.Conn:
+		cs := c.ConnectionState()
+		state = &cs
+	case *tunnel.Conn:
+		result.Detail += " over HTTP long-polling"
+		state = c.ConnectionState()
+	}
+	if state == nil {
+		result.Detail += ", not encrypted"
+		return result
+	}
+	result.Detail += ", " + tls.VersionName(state.Version)
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		result.Detail += fmt.Sprintf(", certificate %s expires %s, pin %s", cert.Subject.CommonName, cert.NotAfter.Format(time.DateOnly), CertificatePin(cert))
+	}
+	return result
+}
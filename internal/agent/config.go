@@ -0,0 +1,271 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"mysql-exporter/internal/update"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is the agent configuration file. Settings it leaves out fall back
+// to the environment and then to the defaults.
+//
+// Any string value may reference secrets instead of containing them:
+// ${file:/run/secrets/db_pass} is replaced by the content of the file, without
+// the trailing newline, and ${env:DB_PASS} by the environment variable.
+type FileConfig struct {
+	ReactorURL  string `yaml:"reactor_url"`
+	AgentKey    string `yaml:"agent_key"`
+	MaxJobs     int    `yaml:"max_jobs"`
+	QueueSize   int    `yaml:"queue_size"`
+	BatchRows   int    `yaml:"batch_rows"`
+	BatchBytes  int    `yaml:"batch_bytes"`
+	Compression string `yaml:"compression"`
+	// DrainTimeout is how long running jobs may finish when the agent shuts down.
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+
+	// Transport is how the agent connects to the Reactor: auto, websocket or poll.
+	Transport string `yaml:"transport"`
+
+	TLS    TLSConfig     `yaml:"tls"`
+	Proxy  ProxyConfig   `yaml:"proxy"`
+	Spool  SpoolConfig   `yaml:"spool"`
+	Update update.Config `yaml:"update"`
+
+	// Policy is the local policy of sources that do not set their own.
+	Policy *PolicyConfig `yaml:"policy"`
+	// Sources are the databases the agent serves; the first is the default.
+	Sources []SourceConfig `yaml:"sources"`
+}
+
+// TLSConfig configures how the agent verifies the Reactor, and how it proves
+// its own identity beyond the agent key.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of certificate authorities trusted in addition
+	// to the system ones, e.g. for a Reactor behind an internal CA.
+	CAFile string `yaml:"ca_file"`
+	// ServerName overrides the name the Reactor certificate is checked against.
+	ServerName string `yaml:"server_name"`
+	// CertFile and KeyFile are the client certificate issued to this agent,
+	// for Reactors that require one. They are read again on every connection,
+	// so a renewed certificate is picked up without a restart.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Pins are public key pins ("sha256/<base64>", see CertificatePin); the
+	// Reactor certificate chain must contain one of them, on top of being
+	// trusted. Pin a backup key too, or a key rotation locks the agent out.
+	Pins []string `yaml:"pins"`
+}
+
+// ProxyConfig routes connections to the Reactor through an HTTP proxy. Without
+// a URL, the HTTPS_PROXY and NO_PROXY environment variables apply.
+type ProxyConfig struct {
+	// URL is the proxy, e.g. http://proxy.internal:3128. WebSocket connections
+	// support http:// proxies only; the poll transport supports https:// too.
+	URL string `yaml:"url"`
+	// Username and Password authenticate with the proxy (Basic), unless the
+	// URL already carries credentials.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// ProxyFunc returns how to pick the proxy for a request to the Reactor, or nil
+// to use the environment.
+func (c ProxyConfig) ProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if c.URL == "" {
+		if c.Username != "" {
+			return nil, fmt.Errorf("proxy username requires a proxy url")
+		}
+		return nil, nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("proxy url %q: expected http://host:port or https://host:port", c.URL)
+	}
+	if c.Username != "" && u.User == nil {
+		u.User = url.UserPassword(c.Username, c.Password)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// LoadConfig reads the agent configuration file at path, resolving secret
+// references. Unknown keys are rejected so typos do not go unnoticed.
+func LoadConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := expandSecrets(&root); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Decode the expanded tree again so unknown keys can be rejected,
+	// which yaml.Node.Decode does not support
+	expanded, err := yaml.Marshal(&root)
+	if err != nil {
+		return nil, err
+	}
+	var cfg FileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(expanded))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	for i := range cfg.Sources {
+		if cfg.Sources[i].Policy == nil {
+			cfg.Sources[i].Policy = cfg.Policy
+		}
+	}
+	if _, err := newPolicy(cfg.Policy); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(cfg.Sources) > 0 {
+		if err := validateSources(cfg.Sources); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return &cfg, nil
+}
+
+var secretRefPattern = regexp.MustCompile(`\$\{(file|env):([^}]*)\}`)
+
+// expandSecrets replaces the secret references in every scalar value of node.
+// Working on the parsed tree means a secret can never change the structure of
+// the file, whatever characters it contains.
+func expandSecrets(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		var expandErr error
+		node.Value = secretRefPattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			m := secretRefPattern.FindStringSubmatch(ref)
+			value, err := resolveSecret(m[1], m[2])
+			if err != nil && expandErr == nil {
+				expandErr = fmt.Errorf("line %d: %w", node.Line, err)
+			}
+			return value
+		})
+		return expandErr
+	}
+
+	for _, child := range node.Content {
+		if err := expandSecrets(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveSecret(kind, ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("empty %s reference", kind)
+	}
+
+	switch kind {
+	case "file":
+		data, err := os.ReadFile(ref)
+		if err != nil {
+			return "", fmt.Errorf("read secret: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	default:
+		value, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", ref)
+		}
+		return value, nil
+	}
+}
+
+// ClientConfig returns the TLS configuration for Reactor connections, or nil
+// if the defaults apply.
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	if c.CAFile == "" && c.ServerName == "" && c.CertFile == "" && c.KeyFile == "" && len(c.Pins) == 0 {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls ca_file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls ca_file %s: no certificates found", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("tls cert_file and key_file must be set together")
+		}
+		// Fail at startup rather than on the first connection
+		if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			return nil, fmt.Errorf("tls client certificate: %w", err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("tls client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	if len(c.Pins) > 0 {
+		pins := make(map[string]bool, len(c.Pins))
+		for _, pin := range c.Pins {
+			if !pinPattern.MatchString(pin) {
+				return nil, fmt.Errorf("tls pin %q: expected sha256/<base64 SHA-256 of the public key>", pin)
+			}
+			pins[pin] = true
+		}
+		// Runs after the chain was verified, on resumed sessions as well
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if pins[CertificatePin(cert)] {
+					return nil
+				}
+			}
+			return fmt.Errorf("reactor certificate %q matches no pinned key", cs.PeerCertificates[0].Subject.CommonName)
+		}
+	}
+	return cfg, nil
+}
+
+var pinPattern = regexp.MustCompile(`^sha256/[A-Za-z0-9+/]{43}=$`)
+
+// CertificatePin returns the public key pin of cert: the base64 SHA-256 of its
+// subject public key info, as used by HPKP and curl --pinnedpubkey.
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"mysql-exporter/internal/driver"
+	"mysql-exporter/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// controlConn serializes writes to the control socket, which is shared by the
+// read loop, the heartbeat loop and running jobs.
+type controlConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *controlConn) Send(msg protocol.ControlMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteJSON(msg)
+}
+
+// heartbeatLoop reports the agent's load until done is closed or a send fails.
+func (a *Agent) heartbeatLoop(ctrl *controlConn, done <-chan struct{}) {
+	ticker := time.NewTicker(protocol.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			msg := protocol.ControlMessage{Type: protocol.TypeHeartbeat, Load: a.load()}
+			if err := ctrl.Send(msg); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (a *Agent) load() *protocol.AgentLoad {
+	a.mu.Lock()
+	load := &protocol.AgentLoad{
+		RunningJobs: a.running,
+		QueuedJobs:  a.queued,
+		MaxJobs:     a.maxJobs,
+		QueueSize:   a.queueSize,
+		Draining:    a.draining.Err() != nil,
+	}
+	a.mu.Unlock()
+
+	// Pool statistics are summed over the sources
+	for _, src := range a.sources {
+		if sr, ok := src.Driver.(driver.StatsReporter); ok {
+			stats := sr.Stats()
+			load.DBOpenConnections += stats.OpenConnections
+			load.DBInUse += stats.InUse
+			load.DBIdle += stats.Idle
+			load.DBWaitCount += stats.WaitCount
+		}
+	}
+	return load
+}
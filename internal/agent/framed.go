@@ -0,0 +1,537 @@
+package agent
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+var errAckTimeout = errors.New("timed out waiting for the reactor to acknowledge row batches")
+
+// connLostError marks a failure of the data connection itself, after which
+// the stream may be resumed on a new connection.
+type connLostError struct {
+	err error
+}
+
+func (e *connLostError) Error() string {
+	return "data connection lost: " + e.err.Error()
+}
+
+func (e *connLostError) Unwrap() error {
+	return e.err
+}
+
+// sentBatch is a row batch kept until the Reactor acknowledges it,
+// so it can be resent if the connection drops first.
+type sentBatch struct {
+	seq   uint64
+	frame protocol.Frame
+}
+
+// framedStream speaks protocol version 2: one frame per WebSocket message.
+// Rows are buffered into batches bounded by row count and estimated size.
+//
+// With flow control, every row batch takes a credit and the Reactor returns
+// credits as it stores batches. Without a credit, sending blocks and with it the
+// caller's loop over the query results, so a slow upload on the Reactor side
+// holds back the query instead of filling buffers in between.
+//
+// Row batches are numbered and kept until acknowledged, at most one window of
+// them. If the connection drops, the stream reconnects, the Reactor reports the
+// last batch it stored and the agent resends the rest, so the job carries on
+// instead of starting over.
+//
+// With a spool, every frame is recorded on disk as well. If the stream cannot
+// be resumed, it goes offline: the job carries on into the spool, which is
+// uploaded once the Reactor is reachable again.
+type framedStream struct {
+	ctx   context.Context
+	hello protocol.Hello
+	dial  func(context.Context) (*websocket.Conn, error)
+
+	conn        *websocket.Conn
+	compression string
+	hash        hash.Hash
+	rows        int64
+	seq         uint64 // last row batch sent
+	resumes     int
+
+	spool   *spoolFile // nil unless the stream is recorded
+	offline bool       // the connection is lost for good, frames only go to the spool
+
+	batch      [][]interface{}
+	batchSize  int
+	batchRows  int
+	batchBytes int
+
+	credits  chan struct{} // nil without flow control
+	acksDone chan struct{} // closed when readAcks stops
+	ackErr   error         // why readAcks stopped, valid once acksDone is closed
+	acked    chan struct{} // signalled on every Ack
+	endAck   bool          // the Reactor acknowledges the End or Error frame
+
+	mu      sync.Mutex
+	unacked []sentBatch
+	ended   bool // the Reactor acknowledged the End or Error frame
+
+	lastProgress time.Time
+}
+
+// attach makes conn the stream's connection, with the settings the Reactor acknowledged.
+func (s *framedStream) attach(conn *websocket.Conn, ack protocol.HelloAck) {
+	s.conn = conn
+	s.compression = ack.Compression
+	s.credits, s.acksDone = nil, nil
+	s.endAck = ack.EndAck
+	if s.acked == nil {
+		s.acked = make(chan struct{}, 1)
+	}
+
+	if s.spool != nil && !ack.Spool {
+		// The Reactor would not wait for an upload, so there is no point
+		s.spool.discard()
+		s.spool = nil
+		s.hello.Spool = false
+	}
+
+	if ack.Window > 0 {
+		s.credits = make(chan struct{}, ack.Window)
+		for range ack.Window {
+			s.credits <- struct{}{}
+		}
+		s.acksDone = make(chan struct{})
+		go s.readAcks(conn, s.credits, s.acksDone)
+	}
+}
+
+// readAcks turns Ack frames into credits until the connection fails. It is the
+// only reader of the connection once the handshake is done.
+func (s *framedStream) readAcks(conn *websocket.Conn, credits chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			s.ackErr = err
+			return
+		}
+		if frame.Type != protocol.FrameAck {
+			slog.Warn("Ignoring unexpected frame from Reactor", "type", frame.Type)
+			continue
+		}
+
+		var ack protocol.Ack
+		if err := frame.Decode(&ack); err != nil {
+			s.ackErr = err
+			return
+		}
+
+		s.mu.Lock()
+		s.trimAcked(ack.Seq)
+		if ack.End {
+			s.ended = true
+		}
+		s.mu.Unlock()
+		select {
+		case s.acked <- struct{}{}:
+		default:
+		}
+
+		for range ack.Batches {
+			select {
+			case credits <- struct{}{}:
+			default: // never hold more than the window
+			}
+		}
+	}
+}
+
+// trimAcked forgets the row batches up to seq. s.mu must be held.
+func (s *framedStream) trimAcked(seq uint64) {
+	i := 0
+	for i < len(s.unacked) && s.unacked[i].seq <= seq {
+		i++
+	}
+	s.unacked = s.unacked[i:]
+}
+
+// takeCredit takes a credit for one row batch, waiting for an Ack if there is none.
+func (s *framedStream) takeCredit() error {
+	if s.credits == nil {
+		return nil
+	}
+	select {
+	case <-s.credits:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(ackTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.credits:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-s.acksDone:
+		return &connLostError{err: s.ackErr}
+	case <-timer.C:
+		return errAckTimeout
+	}
+}
+
+// write sends a frame on the current connection. Offline, frames are only
+// recorded in the spool.
+func (s *framedStream) write(frame protocol.Frame) error {
+	if s.offline {
+		return nil
+	}
+	data, err := frame.Marshal(s.compression)
+	if err != nil {
+		return err
+	}
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return &connLostError{err: err}
+	}
+	return nil
+}
+
+// recover resumes the stream if err means the connection dropped. It returns
+// nil once the stream is resumed or gone offline, or the error that ends the stream.
+func (s *framedStream) recover(err error) error {
+	var lost *connLostError
+	for errors.As(err, &lost) {
+		// Only batches kept for flow control can be resent
+		if s.credits == nil || s.resumes >= maxResumes {
+			break
+		}
+		s.resumes++
+		slog.Warn("Data Stream connection lost, resuming", "id", s.hello.JobID, "attempt", s.resumes, "error", lost.err)
+
+		if err = s.resume(); err == nil {
+			return nil
+		}
+	}
+	return s.goOffline(err)
+}
+
+// goOffline carries on into the spool after the connection was lost for good.
+// It returns err if there is no spool, or the job was cancelled.
+func (s *framedStream) goOffline(err error) error {
+	if s.spool == nil || s.ctx.Err() != nil {
+		return err
+	}
+
+	slog.Warn("Data Stream lost, spooling the rest of the job", "id", s.hello.JobID, "error", err)
+	s.offline = true
+	s.credits = nil
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return nil
+}
+
+// record adds a frame to the spool. A stream whose spool fails carries on
+// without one, unless it is offline and has nowhere else to go.
+func (s *framedStream) record(frame protocol.Frame) error {
+	if s.spool == nil {
+		return nil
+	}
+	err := s.spool.write(frame)
+	if err == nil {
+		return nil
+	}
+
+	s.spool.discard()
+	s.spool = nil
+	if s.offline {
+		return fmt.Errorf("spool: %w", err)
+	}
+	slog.Warn("Failed to spool Data Stream, carrying on without it", "id", s.hello.JobID, "error", err)
+	return nil
+}
+
+// resume reconnects, asks the Reactor where it left off and resends every
+// row batch after that.
+func (s *framedStream) resume() error {
+	s.conn.Close()
+	<-s.acksDone
+
+	conn, err := s.dial(s.ctx)
+	if err != nil {
+		return fmt.Errorf("resume data stream: %w", err)
+	}
+	ack, err := s.handshake(conn, true)
+	if err != nil {
+		conn.Close()
+		return &connLostError{err: err}
+	}
+	if !ack.Resumed {
+		conn.Close()
+		return errors.New("reactor could not resume the data stream")
+	}
+	s.attach(conn, ack)
+
+	s.mu.Lock()
+	s.trimAcked(ack.Seq)
+	pending := slices.Clone(s.unacked)
+	s.mu.Unlock()
+
+	slog.Info("Data Stream resumed", "id", s.hello.JobID, "seq", ack.Seq, "resending", len(pending))
+	for _, b := range pending {
+		// Resent batches use up the window like new ones
+		select {
+		case <-s.credits:
+		default:
+		}
+		if err := s.write(b.frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends a frame other than a row batch, resuming the stream if needed.
+func (s *framedStream) send(t protocol.FrameType, v interface{}) error {
+	frame, err := protocol.NewFrame(t, v)
+	if err != nil {
+		return err
+	}
+	if t == protocol.FrameSchema {
+		s.hash.Write(frame.Payload)
+	}
+	if t != protocol.FrameProgress {
+		if err := s.record(frame); err != nil {
+			return err
+		}
+	}
+	return s.sendFrame(frame)
+}
+
+// sendFrame sends a frame other than a row batch, resuming the stream if needed.
+func (s *framedStream) sendFrame(frame protocol.Frame) error {
+	for {
+		err := s.write(frame)
+		if err == nil {
+			return nil
+		}
+		if err = s.recover(err); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *framedStream) WriteSchema(columns []string, types []protocol.ColumnType) error {
+	return s.send(protocol.FrameSchema, protocol.Schema{Columns: columns, Types: types})
+}
+
+func (s *framedStream) WriteRow(values []interface{}) error {
+	row := make([]interface{}, len(values))
+	copy(row, values)
+	s.batch = append(s.batch, row)
+	s.rows++
+
+	for _, v := range row {
+		s.batchSize += valueSize(v)
+	}
+	if len(s.batch) >= s.batchRows || s.batchSize >= s.batchBytes {
+		return s.flush()
+	}
+	return nil
+}
+
+// valueSize estimates the encoded size of a row value.
+func valueSize(v interface{}) int {
+	switch v := v.(type) {
+	case []byte:
+		return len(v)
+	case string:
+		return len(v)
+	case nil:
+		return 1
+	default:
+		return 8
+	}
+}
+
+func (s *framedStream) flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+
+	s.seq++
+	frame, err := protocol.NewFrame(protocol.FrameRowBatch, protocol.RowBatch{Seq: s.seq, Rows: s.batch})
+	if err != nil {
+		return err
+	}
+	s.hash.Write(frame.Payload)
+	s.batch = s.batch[:0]
+	s.batchSize = 0
+
+	if err := s.record(frame); err != nil {
+		return err
+	}
+	if err := s.sendBatch(s.seq, frame); err != nil {
+		return err
+	}
+
+	if time.Since(s.lastProgress) >= progressInterval {
+		s.lastProgress = time.Now()
+		return s.send(protocol.FrameProgress, protocol.Progress{Rows: s.rows})
+	}
+	return nil
+}
+
+// sendBatch sends row batch seq once a credit is available and keeps it until
+// the Reactor acknowledges it, resuming the stream if needed.
+func (s *framedStream) sendBatch(seq uint64, frame protocol.Frame) error {
+	for {
+		err := s.takeCredit()
+		if err == nil {
+			break
+		}
+		if err = s.recover(err); err != nil {
+			return err
+		}
+	}
+
+	if s.credits != nil {
+		s.mu.Lock()
+		s.unacked = append(s.unacked, sentBatch{seq: seq, frame: frame})
+		s.mu.Unlock()
+	}
+	if err := s.write(frame); err != nil {
+		// Resuming resends the batch along with the other unacknowledged ones
+		if err = s.recover(err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// awaitEnd waits until the Reactor has stored every row batch and, if it
+// acknowledges them, recorded the outcome of the stream. If the connection
+// drops first, the stream is resumed and last, the End or Error frame, sent
+// again. If that fails, the stream goes offline so the spool is kept.
+func (s *framedStream) awaitEnd(last protocol.Frame) error {
+	for !s.offline {
+		err := s.waitAcked()
+		if err == nil {
+			return nil
+		}
+		if err = s.recover(err); err != nil {
+			return err
+		}
+		// Resumed, with the unacknowledged row batches resent
+		if err := s.sendFrame(last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitAcked waits for the Acks awaitEnd needs. Without flow control, the
+// Reactor sends none.
+func (s *framedStream) waitAcked() error {
+	if s.credits == nil {
+		return nil
+	}
+	done := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.unacked) == 0 && (s.ended || !s.endAck)
+	}
+
+	timer := time.NewTimer(ackTimeout)
+	defer timer.Stop()
+	for !done() {
+		select {
+		case <-s.acked:
+		case <-s.acksDone:
+			// The Reactor closes the connection right after the last Ack
+			if done() {
+				return nil
+			}
+			return &connLostError{err: s.ackErr}
+		case <-timer.C:
+			return errAckTimeout
+		}
+	}
+	return nil
+}
+
+func (s *framedStream) Finish(failure *streamFailure) error {
+	var last protocol.Frame
+	var err error
+	if failure == nil {
+		if err := s.flush(); err != nil {
+			return err
+		}
+		last, err = protocol.NewFrame(protocol.FrameEnd, protocol.End{
+			Rows:     s.rows,
+			Checksum: hex.EncodeToString(s.hash.Sum(nil)),
+		})
+	} else {
+		// Rows still buffered were never sent, so they are not counted
+		sent := s.rows - int64(len(s.batch))
+		last, err = protocol.NewFrame(protocol.FrameError, protocol.StreamError{
+			Class:   failure.class,
+			Message: failure.err.Error(),
+			Rows:    sent,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.record(last); err != nil {
+		return err
+	}
+	if err := s.sendFrame(last); err != nil {
+		return err
+	}
+	// Only drop the spool once the Reactor has the whole stream
+	if err := s.awaitEnd(last); err != nil {
+		return err
+	}
+
+	if s.offline {
+		spool := s.spool
+		s.spool = nil
+		if err := spool.commit(); err != nil {
+			return err
+		}
+		slog.Info("Job spooled for upload", "id", s.hello.JobID, "rows", s.rows)
+		return nil
+	}
+	if s.spool != nil {
+		s.spool.discard()
+		s.spool = nil
+	}
+	return closeStream(s.conn, websocket.CloseNormalClosure, "")
+}
+
+func (s *framedStream) Rows() int64 {
+	return s.rows
+}
+
+func (s *framedStream) Close() error {
+	if s.spool != nil {
+		// The stream did not finish, so there is nothing worth uploading
+		s.spool.discard()
+		s.spool = nil
+	}
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"mysql-exporter/internal/driver"
+	"mysql-exporter/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+func (a *Agent) executeJob(ctx context.Context, jobID string, src Source, query string) {
+	slog.Info("Executing Job", "id", jobID, "source", src.Name)
+
+	if src.Policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, src.Policy.Timeout, fmt.Errorf("%w of %s", errTimeLimit, src.Policy.Timeout))
+		defer cancel()
+	}
+
+	// 1. Run Query
+	streamer, queryErr := src.Driver.Query(ctx, query)
+	if queryErr != nil {
+		slog.Error("Query execution failed", "id", jobID, "error", queryErr)
+	} else {
+		defer streamer.Close()
+	}
+
+	// 2. Connect to Data Stream (also when the query failed, to report why)
+	var stream streamWriter
+	conn, err := a.dialData(ctx, jobID)
+	if err == nil {
+		stream, err = a.openStream(ctx, conn, jobID)
+		if err != nil {
+			conn.Close()
+			slog.Error("Data Stream handshake failed", "id", jobID, "error", err)
+			return
+		}
+	} else if ctx.Err() == nil {
+		stream = a.openOfflineStream(ctx, jobID)
+	}
+	if stream == nil {
+		slog.Error("Failed to connect to Data Stream", "id", jobID, "error", err)
+		return
+	}
+	defer stream.Close()
+
+	// 3. Stream Data
+	var failure *streamFailure
+	if queryErr != nil {
+		failure = newFailure(ctx, protocol.ErrorClassQuery, queryErr)
+	} else {
+		failure = sendRows(ctx, stream, streamer, src.Policy.MaxRows)
+	}
+
+	// 4. Finish with the outcome and a normal close
+	if err := stream.Finish(failure); err != nil {
+		slog.Error("Failed to finish Data Stream", "id", jobID, "error", err)
+		return
+	}
+
+	if failure == nil {
+		slog.Info("Job Completed", "id", jobID, "rows", stream.Rows())
+	} else {
+		slog.Warn("Job Failed", "id", jobID, "rows", stream.Rows(), "class", failure.class, "error", failure.err)
+	}
+}
+
+// sendRows streams the header and every row, returning the failure that
+// stopped it, or nil if the result was sent in full. Results with more than
+// maxRows rows fail, unless maxRows is zero.
+func sendRows(ctx context.Context, stream streamWriter, streamer driver.RowStreamer, maxRows int64) *streamFailure {
+	columns, err := streamer.Columns()
+	if err != nil {
+		return newFailure(ctx, protocol.ErrorClassQuery, err)
+	}
+	types, err := streamer.ColumnTypes()
+	if err != nil {
+		// Types only improve the export; send the names alone rather than fail
+		slog.Warn("Failed to read column types", "error", err)
+	}
+	if err := stream.WriteSchema(columns, columnTypes(types)); err != nil {
+		return newFailure(ctx, protocol.ErrorClassEncode, err)
+	}
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for streamer.Next() {
+		if ctx.Err() != nil {
+			break
+		}
+		if maxRows > 0 && stream.Rows() >= maxRows {
+			return newFailure(ctx, protocol.ErrorClassPolicy, fmt.Errorf("result exceeds the limit of %d rows", maxRows))
+		}
+		if err := streamer.Scan(pointers...); err != nil {
+			return newFailure(ctx, protocol.ErrorClassRead, err)
+		}
+		if err := stream.WriteRow(values); err != nil {
+			return newFailure(ctx, protocol.ErrorClassEncode, err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return newFailure(ctx, protocol.ErrorClassCancelled, ctx.Err())
+	}
+	if err := streamer.Err(); err != nil {
+		return newFailure(ctx, protocol.ErrorClassRead, err)
+	}
+	return nil
+}
+
+// streamFailure describes why a job did not complete.
+type streamFailure struct {
+	class string
+	err   error
+}
+
+// newFailure reports the job as cancelled whenever its context was cancelled,
+// whatever the failing step was, as a policy failure if it ran out of time, or
+// as a shutdown failure if the agent stopped it while shutting down.
+func newFailure(ctx context.Context, class string, err error) *streamFailure {
+	if ctx.Err() != nil {
+		cause := context.Cause(ctx)
+		switch {
+		case errors.Is(cause, errTimeLimit):
+			return &streamFailure{class: protocol.ErrorClassPolicy, err: cause}
+		case errors.Is(cause, errShuttingDown):
+			return &streamFailure{class: protocol.ErrorClassShutdown, err: cause}
+		}
+		class = protocol.ErrorClassCancelled
+	}
+	return &streamFailure{class: class, err: err}
+}
+
+// dataDialAttempts bounds how often a job retries opening its data stream,
+// e.g. while the Reactor is restarting, before giving up on the job.
+const dataDialAttempts = 5
+
+func (a *Agent) dialData(ctx context.Context, jobID string) (*websocket.Conn, error) {
+	bo := newBackoff(reconnectMin, reconnectMax)
+	for attempt := 1; ; attempt++ {
+		conn, err := a.dial(ctx, "/agent/data?job_id="+url.QueryEscape(jobID), protocol.Subprotocols...)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt == dataDialAttempts {
+			return nil, err
+		}
+
+		delay := bo.Next()
+		slog.Warn("Data Stream connect failed, retrying", "id", jobID, "attempt", attempt, "error", err, "retry_in", delay.String())
+		if !sleep(ctx, delay) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func closeStream(conn *websocket.Conn, code int, reason string) error {
+	msg := websocket.FormatCloseMessage(code, reason)
+	return conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(5*time.Second))
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"mysql-exporter/internal/exporter"
+	"mysql-exporter/internal/protocol"
+)
+
+// RunQuery runs query on a source the way a job would, policy included, but
+// writes the result to w in the given export format instead of streaming it to
+// the Reactor. It returns the number of rows written.
+func (a *Agent) RunQuery(ctx context.Context, sourceName, query, format string, w io.Writer) (int64, error) {
+	src, ok := a.source(sourceName)
+	if !ok {
+		return 0, fmt.Errorf("unknown source %q", sourceName)
+	}
+	if err := src.Policy.Check(src.Driver.Name(), query); err != nil {
+		return 0, fmt.Errorf("policy: %w", err)
+	}
+	if src.Policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, src.Policy.Timeout, fmt.Errorf("%w of %s", errTimeLimit, src.Policy.Timeout))
+		defer cancel()
+	}
+
+	streamer, err := src.Driver.Query(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer streamer.Close()
+
+	stream := &encoderStream{enc: exporter.NewEncoder(format, w)}
+	failure := sendRows(ctx, stream, streamer, src.Policy.MaxRows)
+	if err := stream.Finish(failure); err != nil && failure == nil {
+		return stream.rows, err
+	}
+	if failure != nil {
+		return stream.rows, fmt.Errorf("%s error: %w", failure.class, failure.err)
+	}
+	return stream.rows, nil
+}
+
+// encoderStream is a streamWriter that writes rows to an export encoder,
+// the same way the Reactor writes the rows it receives.
+type encoderStream struct {
+	enc  exporter.RowEncoder
+	rows int64
+}
+
+func (s *encoderStream) WriteSchema(columns []string, types []protocol.ColumnType) error {
+	if len(types) != len(columns) {
+		return s.enc.WriteHeader(columns)
+	}
+	return exporter.WriteSchema(s.enc, exporterColumns(types))
+}
+
+func (s *encoderStream) WriteRow(values []interface{}) error {
+	if err := s.enc.WriteRow(values); err != nil {
+		return err
+	}
+	s.rows++
+	return nil
+}
+
+func (s *encoderStream) Finish(*streamFailure) error {
+	return s.enc.Close()
+}
+
+func (s *encoderStream) Rows() int64 {
+	return s.rows
+}
+
+func (s *encoderStream) Close() error {
+	return nil
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mysql-exporter/internal/security"
+)
+
+// PolicyConfig is the local policy of a source in the configuration file.
+type PolicyConfig struct {
+	// ValidateQuery applies the Reactor's query validator (SELECT only, no
+	// stacked queries, no system tables) to SQL sources. Defaults to true.
+	ValidateQuery *bool `yaml:"validate_query"`
+	// Tables lists the tables, or collections for MongoDB, that queries may
+	// read: "name", "schema.name" or "schema.*". Empty allows all. Names match
+	// exactly as the server resolves them, so PostgreSQL tables created
+	// without quotes are listed in lower case.
+	Tables []string `yaml:"tables"`
+	// MaxRows fails jobs whose result has more rows. Zero means no limit.
+	MaxRows int64 `yaml:"max_rows"`
+	// Timeout fails jobs that run longer, e.g. "15m". Zero means no limit.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Policy is what a source allows, whatever the Reactor sends. Jobs that
+// violate it are rejected before they reach the database, or failed once they
+// exceed its limits.
+type Policy struct {
+	ValidateQuery bool
+	Tables        []string
+	MaxRows       int64
+	Timeout       time.Duration
+}
+
+// errTimeLimit is the cause of a job context that hit the policy timeout.
+var errTimeLimit = errors.New("job exceeded the time limit")
+
+func newPolicy(cfg *PolicyConfig) (Policy, error) {
+	p := Policy{ValidateQuery: true}
+	if cfg == nil {
+		return p, nil
+	}
+
+	if cfg.ValidateQuery != nil {
+		p.ValidateQuery = *cfg.ValidateQuery
+	}
+	if cfg.MaxRows < 0 {
+		return p, fmt.Errorf("policy: max_rows must not be negative")
+	}
+	if cfg.Timeout < 0 {
+		return p, fmt.Errorf("policy: timeout must not be negative")
+	}
+	for _, t := range cfg.Tables {
+		if t == "" || t == "*" || strings.Count(t, ".") > 1 {
+			return p, fmt.Errorf("policy: invalid table %q, expected name, schema.name or schema.*", t)
+		}
+	}
+	p.Tables = cfg.Tables
+	p.MaxRows = cfg.MaxRows
+	p.Timeout = cfg.Timeout
+	return p, nil
+}
+
+// Check reports why the policy does not allow query on a source using the
+// given driver, or nil if it does.
+func (p Policy) Check(driverName, query string) error {
+	var tables []string
+	if driverName == "mongo" {
+		tables = []string{mongoCollection(query)}
+	} else {
+		if p.ValidateQuery {
+			if err := security.ValidateQuery(query); err != nil {
+				return err
+			}
+		}
+		if len(p.Tables) == 0 {
+			return nil
+		}
+		var err error
+		if tables, err = security.QueryTables(driverName, query); err != nil {
+			return fmt.Errorf("cannot check the tables of the query: %w", err)
+		}
+	}
+
+	if len(p.Tables) == 0 {
+		return nil
+	}
+	// Fail closed: a query whose tables went unseen must not pass
+	if len(tables) == 0 {
+		return errors.New("no table found in the query")
+	}
+	for _, t := range tables {
+		if !p.allowsTable(t) {
+			return fmt.Errorf("table %q is not allowed", t)
+		}
+	}
+	return nil
+}
+
+// allowsTable matches a table reference against the allowlist. Unqualified
+// entries only match unqualified references, so an entry cannot be used to
+// read the same table name from another schema. Names are case-sensitive:
+// QueryTables already folded the ones the server folds.
+func (p Policy) allowsTable(table string) bool {
+	schema, _, qualified := strings.Cut(table, ".")
+	for _, allowed := range p.Tables {
+		if allowed == table {
+			return true
+		}
+		if qualified && allowed == schema+".*" {
+			return true
+		}
+	}
+	return false
+}
+
+// mongoCollection returns the collection of a "[db.]collection.find(...)"
+// query as "collection" or "db.collection".
+func mongoCollection(query string) string {
+	prefix, _, _ := strings.Cut(query, "(")
+	prefix = strings.TrimSpace(prefix)
+	if i := strings.LastIndex(prefix, "."); i != -1 {
+		prefix = prefix[:i] // drop the command
+	}
+	return prefix
+}
@@ -0,0 +1,53 @@
+package agent
+
+import "testing"
+
+func TestPolicyCheckTables(t *testing.T) {
+	p, err := newPolicy(&PolicyConfig{Tables: []string{"allowed", "reporting.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		driver string
+		query  string
+		ok     bool
+	}{
+		{"mysql", "SELECT * FROM allowed", true},
+		{"postgres", "SELECT * FROM reporting.daily JOIN allowed USING (id)", true},
+		{"mysql", "SELECT * FROM secret", false},
+		{"mysql", "SELECT * FROM other.allowed", false},
+		{"mongo", "allowed.find({})", true},
+		{"mongo", "secret.find({})", false},
+		// Names match as the server resolves them
+		{"postgres", "SELECT * FROM ALLOWED", true},
+		{"postgres", `SELECT * FROM "ALLOWED"`, false},
+		{"postgres", "SELECT * FROM Reporting.Daily", true},
+		{"mysql", "SELECT * FROM `ALLOWED`", false},
+		{"mysql", "SELECT * FROM ALLOWED", false},
+		{"mongo", "ALLOWED.find({})", false},
+
+		// Bypasses of the table scanner
+		{"postgres", `SELECT '\', * FROM secret -- ' FROM allowed`, false},
+		{"postgres", "SELECT 1 # 1, s.* FROM secret s", false},
+		{"mysql", "SELECT * FROM allowed STRAIGHT_JOIN secret", false},
+		{"mysql", "SELECT * FROM allowed /*!, secret */", false},
+		{"mysql", "SELECT 'unterminated FROM allowed", false},
+		{"postgres", "SELECT ARRAY(TABLE secret) FROM allowed", false},
+		{"mysql", "SELECT ARRAY(TABLE secret) FROM allowed", false},
+		{"postgres", "SELECT CASE WHEN x THEN (TABLE secret) END FROM allowed", false},
+		{"mysql", "SELECT CASE WHEN x THEN (TABLE secret) END FROM allowed", false},
+		{"postgres", "SELECT * FROM allowed WHERE id BETWEEN (TABLE secret) AND 10", false},
+		{"mysql", "SELECT * FROM allowed WHERE id BETWEEN (TABLE secret) AND 10", false},
+		{"postgres", "SELECT * FROM allowed WHERE y LIKE (TABLE secret)", false},
+		{"mysql", "SELECT * FROM allowed WHERE y LIKE (TABLE secret)", false},
+		// No table found
+		{"mysql", "SELECT 1", false},
+	}
+	for _, tt := range tests {
+		err := p.Check(tt.driver, tt.query)
+		if (err == nil) != tt.ok {
+			t.Errorf("Check(%s, %q) = %v, want allowed %v", tt.driver, tt.query, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"database/sql"
+
+	"mysql-exporter/internal/exporter"
+	"mysql-exporter/internal/protocol"
+)
+
+// columnTypes converts the driver's column metadata for the schema frame.
+func columnTypes(types []*sql.ColumnType) []protocol.ColumnType {
+	if len(types) == 0 {
+		return nil
+	}
+
+	columns := make([]protocol.ColumnType, len(types))
+	for i, ct := range types {
+		c := protocol.ColumnType{
+			Name:         ct.Name(),
+			DatabaseType: ct.DatabaseTypeName(),
+			Nullable:     true,
+		}
+		if nullable, ok := ct.Nullable(); ok {
+			c.Nullable = nullable
+		}
+		if precision, scale, ok := ct.DecimalSize(); ok {
+			c.Precision = precision
+			c.Scale = scale
+		}
+		if length, ok := ct.Length(); ok {
+			c.Length = length
+		}
+		columns[i] = c
+	}
+	return columns
+}
+
+// exporterColumns converts the column types of a schema frame for the
+// encoders of local exports. exporter.Column mirrors protocol.ColumnType.
+func exporterColumns(types []protocol.ColumnType) []exporter.Column {
+	columns := make([]exporter.Column, len(types))
+	for i, t := range types {
+		columns[i] = exporter.Column(t)
+	}
+	return columns
+}
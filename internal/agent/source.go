@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+
+	"mysql-exporter/internal/driver"
+	"mysql-exporter/internal/protocol"
+)
+
+// Source is a named database the agent runs jobs against.
+type Source struct {
+	Name   string
+	Driver driver.Driver
+	Policy Policy
+}
+
+// SourceConfig describes a data source in the agent's sources file.
+type SourceConfig struct {
+	Name string `yaml:"name"`
+	// Driver is "mysql", "postgres" or "mongo".
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+	// Policy restricts the jobs the source runs. Sources without one use the
+	// policy at the top of the configuration file.
+	Policy *PolicyConfig `yaml:"policy"`
+}
+
+var sourceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// LoadSources reads the data sources from a YAML file of the form
+//
+//	sources:
+//	  - name: orders_mysql
+//	    driver: mysql
+//	    dsn: user:pass@tcp(localhost:3306)/orders
+//
+// The file is read like a configuration file, so DSNs may reference secrets.
+// The first source is the default for jobs that do not name one.
+func LoadSources(path string) ([]SourceConfig, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Sources) == 0 {
+		return nil, fmt.Errorf("%s: no sources configured", path)
+	}
+	return cfg.Sources, nil
+}
+
+func validateSources(sources []SourceConfig) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("no sources configured")
+	}
+
+	seen := make(map[string]bool)
+	for i, s := range sources {
+		if !sourceNamePattern.MatchString(s.Name) {
+			return fmt.Errorf("source %d: name %q must be 1-64 letters, digits, '_' or '-'", i+1, s.Name)
+		}
+		if seen[s.Name] {
+			return fmt.Errorf("source %q is configured twice", s.Name)
+		}
+		seen[s.Name] = true
+
+		if s.DSN == "" {
+			return fmt.Errorf("source %q: missing dsn", s.Name)
+		}
+		if _, err := driver.Open(s.Driver, ""); err != nil {
+			return fmt.Errorf("source %q: %w", s.Name, err)
+		}
+		if _, err := newPolicy(s.Policy); err != nil {
+			return fmt.Errorf("source %q: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// OpenSources creates the drivers of the configured sources. Connections are
+// established on first use.
+func OpenSources(configs []SourceConfig) ([]Source, error) {
+	sources := make([]Source, 0, len(configs))
+	for _, cfg := range configs {
+		d, err := driver.Open(cfg.Driver, cfg.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %w", cfg.Name, err)
+		}
+		policy, err := newPolicy(cfg.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %w", cfg.Name, err)
+		}
+		sources = append(sources, Source{Name: cfg.Name, Driver: d, Policy: policy})
+	}
+	return sources, nil
+}
+
+// source returns the source a job targets. An empty name selects the default
+// source, so Reactors that predate named sources keep working.
+func (a *Agent) source(name string) (Source, bool) {
+	if name == "" {
+		return a.sources[0], true
+	}
+	for _, s := range a.sources {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Source{}, false
+}
+
+// sourceInfo lists the sources announced to the Reactor.
+func (a *Agent) sourceInfo() []protocol.SourceInfo {
+	info := make([]protocol.SourceInfo, len(a.sources))
+	for i, s := range a.sources {
+		info[i] = protocol.SourceInfo{Name: s.Name, Driver: s.Driver.Name()}
+	}
+	return info
+}
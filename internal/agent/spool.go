@@ -0,0 +1,471 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// SpoolConfig configures the on-disk spool in the configuration file.
+type SpoolConfig struct {
+	// Dir is the directory spooled streams are kept in. Empty disables the spool.
+	Dir string `yaml:"dir"`
+	// MaxBytes bounds the size of all spooled streams together. Jobs whose
+	// stream does not fit are not spooled.
+	MaxBytes int64 `yaml:"max_bytes"`
+	// MaxAge is how long a spooled stream is kept for upload before it is dropped.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+const (
+	defaultSpoolMaxBytes = 1 << 30
+	defaultSpoolMaxAge   = 24 * time.Hour
+
+	// spoolUploadInterval is how often complete spools are retried while the
+	// agent is connected to the Reactor.
+	spoolUploadInterval = time.Minute
+)
+
+// Spool file suffixes: a stream is written to a partial file, which is renamed
+// once the stream is finished and ready for upload.
+const (
+	spoolSuffix   = ".spool"
+	partialSuffix = ".partial"
+)
+
+var (
+	errSpoolFull = errors.New("spool is full")
+	// errSpoolCorrupt means a spool file cannot be read back, so it can never
+	// be uploaded.
+	errSpoolCorrupt = errors.New("corrupt spool file")
+
+	// spoolJobIDPattern keeps job IDs used as file names to safe characters.
+	spoolJobIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// Spool keeps the data streams of jobs on disk, so a job whose data connection
+// is lost for good can finish into a file and be uploaded once the Reactor is
+// reachable again, e.g. a nightly export during a short Reactor outage.
+//
+// Every frame of a stream is recorded while it is sent. Streams the Reactor
+// received in full are deleted straight away; the others are kept until they
+// are uploaded or expire.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu     sync.Mutex
+	used   int64           // bytes of all spool files
+	active map[string]bool // jobs whose stream is being recorded
+
+	uploading atomic.Bool
+}
+
+// OpenSpool creates the spool directory if needed and accounts for the
+// streams left in it by an earlier run.
+func OpenSpool(cfg SpoolConfig) (*Spool, error) {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultSpoolMaxBytes
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = defaultSpoolMaxAge
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+
+	sp := &Spool{
+		dir:      cfg.Dir,
+		maxBytes: cfg.MaxBytes,
+		maxAge:   cfg.MaxAge,
+		active:   make(map[string]bool),
+	}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() {
+			sp.used += info.Size()
+		}
+	}
+	return sp, nil
+}
+
+// reserve accounts for n more bytes, reporting false if they do not fit.
+func (sp *Spool) reserve(n int64) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.used+n > sp.maxBytes {
+		return false
+	}
+	sp.used += n
+	return true
+}
+
+func (sp *Spool) release(n int64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.used -= n
+}
+
+// remove deletes a spool file and releases its size.
+func (sp *Spool) remove(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		slog.Warn("Failed to remove spool file", "path", path, "error", err)
+		return
+	}
+	sp.release(info.Size())
+}
+
+// create starts recording the stream of a job.
+func (sp *Spool) create(jobID string) (*spoolFile, error) {
+	if !spoolJobIDPattern.MatchString(jobID) {
+		return nil, fmt.Errorf("job ID %q cannot be used as a file name", jobID)
+	}
+
+	path := filepath.Join(sp.dir, jobID+partialSuffix)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	sp.mu.Lock()
+	sp.active[jobID] = true
+	sp.mu.Unlock()
+	return &spoolFile{spool: sp, jobID: jobID, path: path, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// spoolFile records the frames of one stream, each as its wire form with
+// spoolCompression, preceded by its length as a big-endian uint32.
+type spoolFile struct {
+	spool *Spool
+	jobID string
+	path  string
+	f     *os.File
+	w     *bufio.Writer
+	size  int64
+}
+
+const spoolCompression = protocol.CompressionZstd
+
+func (f *spoolFile) write(frame protocol.Frame) error {
+	data, err := frame.Marshal(spoolCompression)
+	if err != nil {
+		return err
+	}
+	n := int64(4 + len(data))
+	if !f.spool.reserve(n) {
+		return errSpoolFull
+	}
+	f.size += n
+
+	if err := binary.Write(f.w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err = f.w.Write(data)
+	return err
+}
+
+// commit makes the finished stream ready for upload.
+func (f *spoolFile) commit() error {
+	err := f.w.Flush()
+	if err == nil {
+		err = f.f.Sync()
+	}
+	if closeErr := f.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.path, filepath.Join(f.spool.dir, f.jobID+spoolSuffix))
+	}
+	f.spool.mu.Lock()
+	delete(f.spool.active, f.jobID)
+	f.spool.mu.Unlock()
+
+	if err != nil {
+		f.remove()
+		return fmt.Errorf("spool: %w", err)
+	}
+	return nil
+}
+
+// discard deletes the recording, e.g. once the Reactor received the stream.
+func (f *spoolFile) discard() {
+	f.f.Close()
+	f.remove()
+
+	f.spool.mu.Lock()
+	delete(f.spool.active, f.jobID)
+	f.spool.mu.Unlock()
+}
+
+func (f *spoolFile) remove() {
+	if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Failed to remove spool file", "path", f.path, "error", err)
+	}
+	f.spool.release(f.size)
+}
+
+// readSpoolFrame reads the next frame of a spool file.
+func readSpoolFrame(r *bufio.Reader) (protocol.Frame, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return protocol.Frame{}, err // io.EOF at the end of the file
+	}
+	if n > protocol.MaxPayloadSize {
+		return protocol.Frame{}, fmt.Errorf("spool frame of %d bytes is too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return protocol.Frame{}, io.ErrUnexpectedEOF
+	}
+	frame, err := protocol.DecodeFrame(data)
+	// The payload is decompressed now and compressed again as it is sent
+	frame.Flags = 0
+	return frame, err
+}
+
+// spoolLoop uploads the spool whenever the agent connects to the Reactor and
+// then regularly while it stays connected, until done is closed or the agent
+// starts draining.
+func (a *Agent) spoolLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(spoolUploadInterval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(a.draining)
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	for {
+		a.uploadSpool(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// uploadSpool uploads the finished spooled streams, oldest first, and drops
+// the ones that expired or were left unfinished by an earlier run. It stops at
+// the first upload that fails, as the others would most likely fail too.
+func (a *Agent) uploadSpool(ctx context.Context) {
+	sp := a.spool
+	if sp == nil || !sp.uploading.CompareAndSwap(false, true) {
+		return
+	}
+	defer sp.uploading.Store(false)
+
+	entries, err := os.ReadDir(sp.dir)
+	if err != nil {
+		slog.Error("Failed to read spool directory", "error", err)
+		return
+	}
+	type spooled struct {
+		jobID, path string
+		modTime     time.Time
+		partial     bool
+	}
+	var files []spooled
+	for _, e := range entries {
+		name := e.Name()
+		jobID, partial := strings.CutSuffix(name, partialSuffix)
+		if !partial {
+			var ok bool
+			if jobID, ok = strings.CutSuffix(name, spoolSuffix); !ok {
+				continue
+			}
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, spooled{jobID: jobID, path: filepath.Join(sp.dir, name), modTime: info.ModTime(), partial: partial})
+	}
+	slices.SortFunc(files, func(x, y spooled) int { return x.modTime.Compare(y.modTime) })
+
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return
+		}
+
+		var reason string
+		switch {
+		case f.partial:
+			sp.mu.Lock()
+			active := sp.active[f.jobID]
+			sp.mu.Unlock()
+			if active {
+				continue
+			}
+			reason = "agent stopped before the spooled job finished"
+		case time.Since(f.modTime) > sp.maxAge:
+			reason = fmt.Sprintf("spooled stream expired after %s", sp.maxAge)
+		}
+
+		if reason == "" {
+			err := a.uploadSpoolFile(ctx, f.jobID, f.path)
+			var rejected *spoolRejectedError
+			switch {
+			case err == nil:
+				slog.Info("Uploaded spooled Data Stream", "id", f.jobID)
+				sp.remove(f.path)
+				continue
+			case errors.Is(err, errSpoolCorrupt):
+				reason = err.Error()
+			case errors.As(err, &rejected):
+				slog.Warn("Reactor refused spooled Data Stream, dropping it", "id", f.jobID, "error", err)
+				sp.remove(f.path)
+				continue
+			default:
+				slog.Warn("Failed to upload spooled Data Stream", "id", f.jobID, "error", err)
+				return
+			}
+		}
+
+		// Keep the file until the Reactor knows, unless it refuses to hear it
+		err := a.reportSpoolDropped(ctx, f.jobID, reason)
+		var rejected *spoolRejectedError
+		if err != nil && !errors.As(err, &rejected) {
+			slog.Warn("Failed to report dropped spool to Reactor", "id", f.jobID, "error", err)
+			return
+		}
+		slog.Warn("Dropped spooled Data Stream", "id", f.jobID, "reason", reason)
+		sp.remove(f.path)
+	}
+}
+
+// spoolRejectedError means the Reactor will never take a spooled stream,
+// e.g. because the job is finished or unknown, so retrying is pointless.
+type spoolRejectedError struct {
+	err error
+}
+
+func (e *spoolRejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *spoolRejectedError) Unwrap() error {
+	return e.err
+}
+
+// dialSpooled opens a data stream that replays a spooled one.
+func (a *Agent) dialSpooled(ctx context.Context, jobID string) (*framedStream, error) {
+	conn, resp, err := a.dialResponse(ctx, "/agent/data?job_id="+url.QueryEscape(jobID), protocol.Subprotocols...)
+	if err != nil {
+		if resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return nil, &spoolRejectedError{err: err}
+		}
+		return nil, err
+	}
+	if protocol.SubprotocolVersion(conn.Subprotocol()) == protocol.LegacyVersion {
+		conn.Close()
+		return nil, &spoolRejectedError{err: errors.New("reactor does not support framed data streams")}
+	}
+
+	s := a.newFramedStream(ctx, jobID, protocol.SubprotocolVersion(conn.Subprotocol()))
+	// Spool as well, so the job waits for another upload if this one is cut off
+	s.hello.Spooled = true
+	s.hello.Spool = true
+	ack, err := s.handshake(conn, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.attach(conn, ack)
+	return s, nil
+}
+
+// uploadSpoolFile replays a spooled stream as a new data stream. A file that
+// cannot be read back fails with errSpoolCorrupt, leaving the job to be
+// reported as dropped.
+func (a *Agent) uploadSpoolFile(ctx context.Context, jobID, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	s, err := a.dialSpooled(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	slog.Info("Uploading spooled Data Stream", "id", jobID)
+	var last protocol.Frame
+	for {
+		frame, err := readSpoolFrame(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errSpoolCorrupt, err)
+		}
+
+		if frame.Type == protocol.FrameRowBatch {
+			s.seq++
+			err = s.sendBatch(s.seq, frame)
+		} else {
+			err = s.sendFrame(frame)
+		}
+		if err != nil {
+			return err
+		}
+		last = frame
+	}
+	// The spool file is removed once this returns
+	if err := s.awaitEnd(last); err != nil {
+		return err
+	}
+	return closeStream(s.conn, websocket.CloseNormalClosure, "")
+}
+
+// reportSpoolDropped tells the Reactor that a spooled stream will not be
+// uploaded, so the job does not wait for it forever.
+func (a *Agent) reportSpoolDropped(ctx context.Context, jobID, reason string) error {
+	s, err := a.dialSpooled(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	frame, err := protocol.NewFrame(protocol.FrameError, protocol.StreamError{Class: protocol.ErrorClassSpool, Message: reason})
+	if err != nil {
+		return err
+	}
+	if err := s.sendFrame(frame); err != nil {
+		return err
+	}
+	if err := s.awaitEnd(frame); err != nil {
+		return err
+	}
+	return closeStream(s.conn, websocket.CloseNormalClosure, "")
+}
@@ -0,0 +1,276 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+func openTestSpool(t *testing.T, maxBytes int64) *Spool {
+	t.Helper()
+	sp, err := OpenSpool(SpoolConfig{Dir: t.TempDir(), MaxBytes: maxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func newFrame(t *testing.T, ft protocol.FrameType, v interface{}) protocol.Frame {
+	t.Helper()
+	frame, err := protocol.NewFrame(ft, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	sp := openTestSpool(t, 0)
+	frames := []protocol.Frame{
+		newFrame(t, protocol.FrameSchema, protocol.Schema{Columns: []string{"id", "name"}}),
+		newFrame(t, protocol.FrameRowBatch, protocol.RowBatch{Seq: 1, Rows: [][]interface{}{
+			{int64(1), strings.Repeat("compressible ", 100)},
+			{int64(2), nil},
+		}}),
+		newFrame(t, protocol.FrameEnd, protocol.End{Rows: 2, Checksum: "abc"}),
+	}
+
+	f, err := sp.create("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		if err := f.write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(sp.dir, "job-1"+spoolSuffix)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.used != info.Size() {
+		t.Errorf("spool uses %d bytes, file has %d", sp.used, info.Size())
+	}
+	if len(sp.active) != 0 {
+		t.Errorf("committed stream is still active: %v", sp.active)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	for i, want := range frames {
+		got, err := readSpoolFrame(r)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		// Frames come back uncompressed, with the payload the checksum covers
+		if got.Type != want.Type || got.Flags != 0 || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("frame %d = %s flags %#x, want %s as written", i, got.Type, got.Flags, want.Type)
+		}
+	}
+	if _, err := readSpoolFrame(r); err != io.EOF {
+		t.Errorf("after the last frame: %v, want io.EOF", err)
+	}
+
+	sp.remove(path)
+	if sp.used != 0 {
+		t.Errorf("spool uses %d bytes after removing its only file", sp.used)
+	}
+}
+
+func TestReadSpoolFrameInvalid(t *testing.T) {
+	data, err := newFrame(t, protocol.FrameEnd, protocol.End{Rows: 1}).Marshal(spoolCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.BigEndian, uint32(len(data)))
+	frame.Write(data)
+
+	for _, n := range []int{2, 4, frame.Len() - 1} {
+		r := bufio.NewReader(bytes.NewReader(frame.Bytes()[:n]))
+		if _, err := readSpoolFrame(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("frame truncated to %d bytes: %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+
+	var oversized bytes.Buffer
+	binary.Write(&oversized, binary.BigEndian, uint32(protocol.MaxPayloadSize+1))
+	if _, err := readSpoolFrame(bufio.NewReader(&oversized)); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("oversized frame: %v, want too large", err)
+	}
+
+	var corrupt bytes.Buffer
+	binary.Write(&corrupt, binary.BigEndian, uint32(3))
+	corrupt.Write([]byte{byte(protocol.FrameRowBatch), protocol.FlagZstd, 1})
+	if _, err := readSpoolFrame(bufio.NewReader(&corrupt)); err == nil {
+		t.Error("corrupt frame was read")
+	}
+}
+
+func TestSpoolReserve(t *testing.T) {
+	sp := openTestSpool(t, 100)
+	if !sp.reserve(60) || !sp.reserve(40) {
+		t.Fatal("reservations up to the limit were refused")
+	}
+	if sp.reserve(1) {
+		t.Fatal("reservation beyond the limit was granted")
+	}
+	sp.release(40)
+	if !sp.reserve(30) {
+		t.Fatal("released bytes cannot be reserved again")
+	}
+	if sp.used != 90 {
+		t.Errorf("spool uses %d bytes, want 90", sp.used)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	sp := openTestSpool(t, 64)
+	f, err := sp.create("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := protocol.RowBatch{Seq: 1, Rows: [][]interface{}{{strings.Repeat("x", 64)}}}
+	if err := f.write(newFrame(t, protocol.FrameRowBatch, batch)); !errors.Is(err, errSpoolFull) {
+		t.Fatalf("write beyond the limit: %v, want %v", err, errSpoolFull)
+	}
+	f.discard()
+	if sp.used != 0 {
+		t.Errorf("spool uses %d bytes after discarding its only stream", sp.used)
+	}
+	if _, err := os.Stat(f.path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("discarded stream left %s: %v", f.path, err)
+	}
+}
+
+func TestOpenSpoolAccountsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "job-1"+spoolSuffix), make([]byte, 10), 0o600)
+	os.WriteFile(filepath.Join(dir, "job-2"+partialSuffix), make([]byte, 5), 0o600)
+
+	sp, err := OpenSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.used != 15 {
+		t.Errorf("spool uses %d bytes, want 15", sp.used)
+	}
+	if sp.maxBytes != defaultSpoolMaxBytes || sp.maxAge != defaultSpoolMaxAge {
+		t.Errorf("limits %d and %s, want the defaults", sp.maxBytes, sp.maxAge)
+	}
+}
+
+func TestSpoolCreateRejectsUnsafeJobID(t *testing.T) {
+	sp := openTestSpool(t, 0)
+	for _, jobID := range []string{"", "../job", "job/1", strings.Repeat("j", 65)} {
+		if _, err := sp.create(jobID); err == nil {
+			t.Errorf("create(%q) succeeded", jobID)
+		}
+	}
+}
+
+// spoolReactor is a Reactor data endpoint that takes spooled uploads. It
+// counts the connections and passes on the Error frames agents send.
+type spoolReactor struct {
+	mu     sync.Mutex
+	conns  int
+	errors chan protocol.StreamError
+}
+
+func (r *spoolReactor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	upgrader := websocket.Upgrader{Subprotocols: protocol.Subprotocols}
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r.mu.Lock()
+	r.conns++
+	r.mu.Unlock()
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		switch frame.Type {
+		case protocol.FrameHello:
+			data, _ := protocol.EncodeFrame(protocol.FrameHelloAck, protocol.HelloAck{
+				Version:     protocol.ProtocolVersion,
+				Compression: protocol.CompressionNone,
+				Spool:       true,
+			})
+			conn.WriteMessage(websocket.BinaryMessage, data)
+		case protocol.FrameError:
+			var streamErr protocol.StreamError
+			frame.Decode(&streamErr)
+			r.errors <- streamErr
+		}
+	}
+}
+
+func TestUploadSpoolReportsCorruptFile(t *testing.T) {
+	sp := openTestSpool(t, 0)
+	f, err := sp.create("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.write(newFrame(t, protocol.FrameSchema, protocol.Schema{Columns: []string{"id"}})); err != nil {
+		t.Fatal(err)
+	}
+	// A frame cut off, e.g. by a full disk
+	f.w.Write([]byte{0, 0, 1, 0, byte(protocol.FrameRowBatch)})
+	if err := f.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	reactor := &spoolReactor{errors: make(chan protocol.StreamError, 1)}
+	srv := httptest.NewServer(reactor)
+	defer srv.Close()
+	a := &Agent{reactorURL: "ws" + strings.TrimPrefix(srv.URL, "http"), spool: sp}
+
+	a.uploadSpool(context.Background())
+
+	if _, err := os.Stat(filepath.Join(sp.dir, "job-1"+spoolSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("corrupt spool file was kept: %v", err)
+	}
+	// The Reactor learns that the upload will not come, so the job does not
+	// wait for it forever
+	select {
+	case streamErr := <-reactor.errors:
+		if streamErr.Class != protocol.ErrorClassSpool || !strings.Contains(streamErr.Message, "corrupt spool file") {
+			t.Errorf("reported %+v, want a corrupt spool file", streamErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dropped spool was not reported")
+	}
+	reactor.mu.Lock()
+	defer reactor.mu.Unlock()
+	if reactor.conns != 2 {
+		t.Errorf("reactor got %d connections, want the upload and the report", reactor.conns)
+	}
+}
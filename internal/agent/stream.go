@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamWriter is one version of the data stream protocol.
+type streamWriter interface {
+	// WriteSchema sends the column names and, if the protocol supports them, types.
+	WriteSchema(columns []string, types []protocol.ColumnType) error
+	// WriteRow sends a row. values may be reused by the caller after it returns.
+	WriteRow(values []interface{}) error
+	// Finish ends the stream, reporting failure, or success if it is nil.
+	Finish(failure *streamFailure) error
+	// Rows returns the number of rows written so far.
+	Rows() int64
+	// Close closes the stream's current connection.
+	Close() error
+}
+
+const (
+	// handshakeTimeout bounds the wait for the Reactor's HelloAck.
+	handshakeTimeout = 30 * time.Second
+	// progressInterval is how often a progress frame is sent.
+	progressInterval = 2 * time.Second
+	// ackTimeout bounds how long a stream waits for the Reactor to acknowledge
+	// row batches before giving up on it.
+	ackTimeout = 5 * time.Minute
+	// maxResumes bounds how often a stream reconnects after its connection dropped.
+	maxResumes = 5
+)
+
+// openStream picks the stream version negotiated during the WebSocket upgrade.
+// Reactors that predate framing do not select a subprotocol and get the legacy stream.
+// Waiting for flow control credits stops when ctx is done.
+func (a *Agent) openStream(ctx context.Context, conn *websocket.Conn, jobID string) (streamWriter, error) {
+	version := protocol.SubprotocolVersion(conn.Subprotocol())
+	if version == protocol.LegacyVersion {
+		return newLegacyStream(conn), nil
+	}
+
+	s := a.newFramedStream(ctx, jobID, version)
+	a.startSpool(s)
+	ack, err := s.handshake(conn, false)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.attach(conn, ack)
+	return s, nil
+}
+
+// openOfflineStream starts the stream of a job straight into the spool, for
+// when the data channel cannot be opened at all. It returns nil without a spool.
+func (a *Agent) openOfflineStream(ctx context.Context, jobID string) streamWriter {
+	s := a.newFramedStream(ctx, jobID, protocol.ProtocolVersion)
+	if a.startSpool(s); s.spool == nil {
+		return nil
+	}
+	s.offline = true
+	slog.Warn("Data Stream unavailable, spooling the job", "id", jobID)
+	return s
+}
+
+func (a *Agent) newFramedStream(ctx context.Context, jobID string, version int) *framedStream {
+	return &framedStream{
+		ctx:          ctx,
+		hash:         sha256.New(),
+		batchRows:    a.batchRows,
+		batchBytes:   a.batchBytes,
+		lastProgress: time.Now(),
+		dial: func(ctx context.Context) (*websocket.Conn, error) {
+			return a.dialData(ctx, jobID)
+		},
+		hello: protocol.Hello{
+			Version:      version,
+			AgentVersion: a.version,
+			JobID:        jobID,
+			Compression:  a.compression,
+		},
+	}
+}
+
+// startSpool records the stream in the spool, if the agent has one.
+func (a *Agent) startSpool(s *framedStream) {
+	if a.spool == nil {
+		return
+	}
+	f, err := a.spool.create(s.hello.JobID)
+	if err != nil {
+		slog.Warn("Failed to spool Data Stream, carrying on without it", "id", s.hello.JobID, "error", err)
+		return
+	}
+	s.spool = f
+	s.hello.Spool = true
+}
+
+// handshake exchanges Hello and HelloAck on a new data connection.
+func (s *framedStream) handshake(conn *websocket.Conn, resume bool) (protocol.HelloAck, error) {
+	var ack protocol.HelloAck
+
+	hello := s.hello
+	hello.Resume = resume
+	data, err := protocol.EncodeFrame(protocol.FrameHello, hello)
+	if err != nil {
+		return ack, err
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return ack, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	frame, err := readFrame(conn)
+	if err != nil {
+		return ack, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if frame.Type != protocol.FrameHelloAck {
+		return ack, fmt.Errorf("expected hello_ack, got %s", frame.Type)
+	}
+	if err := frame.Decode(&ack); err != nil {
+		return ack, err
+	}
+	if ack.Version != hello.Version {
+		return ack, fmt.Errorf("reactor answered with protocol version %d, negotiated %d", ack.Version, hello.Version)
+	}
+	if ack.Compression != protocol.CompressionNone && !slices.Contains(hello.Compression, ack.Compression) {
+		return ack, fmt.Errorf("reactor chose compression %q, which was not offered", ack.Compression)
+	}
+	return ack, nil
+}
+
+func readFrame(conn *websocket.Conn) (protocol.Frame, error) {
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	if messageType != websocket.BinaryMessage {
+		return protocol.Frame{}, fmt.Errorf("unexpected message type %d", messageType)
+	}
+	return protocol.DecodeFrame(data)
+}
+
+// legacyStream speaks protocol version 1 for Reactors that predate framing:
+// gob-encoded header and rows, one binary message per gob write, then a JSON trailer.
+type legacyStream struct {
+	conn *websocket.Conn
+	enc  *gob.Encoder
+	hash hash.Hash
+	rows int64
+}
+
+func newLegacyStream(conn *websocket.Conn) *legacyStream {
+	h := sha256.New()
+	return &legacyStream{
+		conn: conn,
+		enc:  gob.NewEncoder(io.MultiWriter(h, &WSWriter{Conn: conn})),
+		hash: h,
+	}
+}
+
+func (s *legacyStream) WriteSchema(columns []string, _ []protocol.ColumnType) error {
+	return s.enc.Encode(columns)
+}
+
+func (s *legacyStream) WriteRow(values []interface{}) error {
+	if err := s.enc.Encode(values); err != nil {
+		return err
+	}
+	s.rows++
+	return nil
+}
+
+func (s *legacyStream) Finish(failure *streamFailure) error {
+	trailer := protocol.StreamTrailer{
+		Status:   protocol.TrailerOK,
+		Rows:     s.rows,
+		Checksum: hex.EncodeToString(s.hash.Sum(nil)),
+	}
+	if failure != nil {
+		trailer.Status = protocol.TrailerError
+		trailer.Error = failure.err.Error()
+		trailer.ErrorClass = failure.class
+	}
+
+	if err := s.conn.WriteJSON(trailer); err != nil {
+		return err
+	}
+	return closeStream(s.conn, websocket.CloseNormalClosure, "")
+}
+
+func (s *legacyStream) Rows() int64 {
+	return s.rows
+}
+
+func (s *legacyStream) Close() error {
+	return s.conn.Close()
+}
+
+type WSWriter struct {
+	Conn *websocket.Conn
+}
+
+func (w *WSWriter) Write(p []byte) (n int, err error) {
+	err = w.Conn.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
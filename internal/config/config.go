@@ -22,6 +22,10 @@ type Config struct {
 	S3Endpoint string
 	// S3PathStyle enables path-style addressing (required for some S3 providers).
 	S3PathStyle bool
+	// AWSAccessKeyID and AWSSecretAccessKey are optional static S3 credentials;
+	// without them the default AWS credential chain is used.
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
 	// StorageType determines where to save exports: "local" or "s3".
 	StorageType string
 	// LocalStoragePath is the directory for local exports.
@@ -47,31 +51,50 @@ type Config struct {
 	APISecret string
 	// AllowedOrigins is a list of CORS allowed domains.
 	AllowedOrigins []string
+	// TLSCertFile and TLSKeyFile make the Reactor serve HTTPS itself, which
+	// client certificates need, instead of behind a TLS-terminating proxy.
+	TLSCertFile string
+	TLSKeyFile  string
+	// AgentClientCAFile is a PEM bundle of the CAs agent client certificates
+	// are issued by. A certificate an agent presents must then match its key.
+	AgentClientCAFile string
+	// AgentRequireCert rejects agents that connect without a client certificate.
+	AgentRequireCert bool
+	// AgentVersion is the latest agent release (e.g. v2.0.5), advertised to
+	// connecting agents that run a different one. Empty advertises nothing.
+	AgentVersion string
 }
 
 func Load() *Config {
 	return &Config{
-		AppEnv:            getEnv("APP_ENV", "development"),
-		AllowedOrigins:    getEnvSlice("ALLOWED_ORIGINS", []string{"*"}),
-		ServerPort:        getEnv("SERVER_PORT", "8080"),
-		MySQLDSN:          getEnv("MYSQL_DSN", "user:password@tcp(localhost:3306)/dbname?parseTime=true"),
-		AWSRegion:         getEnv("AWS_REGION", "us-east-1"),
-		S3Bucket:          getEnv("S3_BUCKET", "my-export-bucket"),
-		S3Endpoint:        getEnv("S3_ENDPOINT", ""),
-		S3PathStyle:       getEnvBool("S3_PATH_STYLE", false),
-		StorageType:       getEnv("STORAGE_TYPE", "s3"),
-		LocalStoragePath:  getEnv("LOCAL_STORAGE_PATH", "./exports"),
-		SMTPHost:          getEnv("SMTP_HOST", ""),
-		SMTPPort:          getEnvInt("SMTP_PORT", 587),
-		SMTPUser:          getEnv("SMTP_USER", ""),
-		SMTPPassword:      getEnv("SMTP_PASS", ""),
-		SMTPFrom:          getEnv("SMTP_FROM", "noreply@example.com"),
-		WorkerCount:       getEnvInt("WORKER_COUNT", 5),
-		MaxDBConcurrency:  int64(getEnvInt("MAX_DB_CONCURRENCY", 3)),
-		DefaultTimeout:    getEnvDuration("DEFAULT_TIMEOUT", 15*time.Minute),
-		ConfigCompression: getEnvBool("COMPRESSION", false),
-		AttachFile:        getEnvBool("EMAIL_ATTACH_FILE", false),
-		APISecret:         getEnv("API_SECRET", ""),
+		AppEnv:             getEnv("APP_ENV", "development"),
+		AllowedOrigins:     getEnvSlice("ALLOWED_ORIGINS", []string{"*"}),
+		ServerPort:         getEnv("SERVER_PORT", "8080"),
+		MySQLDSN:           getEnv("MYSQL_DSN", "user:password@tcp(localhost:3306)/dbname?parseTime=true"),
+		AWSRegion:          getEnv("AWS_REGION", "us-east-1"),
+		S3Bucket:           getEnv("S3_BUCKET", "my-export-bucket"),
+		S3Endpoint:         getEnv("S3_ENDPOINT", ""),
+		S3PathStyle:        getEnvBool("S3_PATH_STYLE", false),
+		AWSAccessKeyID:     getEnv("AWS_ACCESS_KEY_ID", ""),
+		AWSSecretAccessKey: getEnv("AWS_SECRET_ACCESS_KEY", ""),
+		StorageType:        getEnv("STORAGE_TYPE", "s3"),
+		LocalStoragePath:   getEnv("LOCAL_STORAGE_PATH", "./exports"),
+		SMTPHost:           getEnv("SMTP_HOST", ""),
+		SMTPPort:           getEnvInt("SMTP_PORT", 587),
+		SMTPUser:           getEnv("SMTP_USER", ""),
+		SMTPPassword:       getEnv("SMTP_PASS", ""),
+		SMTPFrom:           getEnv("SMTP_FROM", "noreply@example.com"),
+		WorkerCount:        getEnvInt("WORKER_COUNT", 5),
+		MaxDBConcurrency:   int64(getEnvInt("MAX_DB_CONCURRENCY", 3)),
+		DefaultTimeout:     getEnvDuration("DEFAULT_TIMEOUT", 15*time.Minute),
+		ConfigCompression:  getEnvBool("COMPRESSION", false),
+		AttachFile:         getEnvBool("EMAIL_ATTACH_FILE", false),
+		APISecret:          getEnv("API_SECRET", ""),
+		TLSCertFile:        getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:         getEnv("TLS_KEY_FILE", ""),
+		AgentClientCAFile:  getEnv("AGENT_CLIENT_CA_FILE", ""),
+		AgentRequireCert:   getEnvBool("AGENT_REQUIRE_CLIENT_CERT", false),
+		AgentVersion:       getEnv("AGENT_LATEST_VERSION", ""),
 	}
 }
 
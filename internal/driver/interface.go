@@ -3,6 +3,7 @@ package driver
 import (
 	"context"
 	"database/sql"
+	"fmt"
 )
 
 // Driver abstracts the database connection and query execution.
@@ -20,6 +21,12 @@ type Driver interface {
 	Close() error
 }
 
+// StatsReporter is implemented by drivers backed by a database/sql connection pool.
+type StatsReporter interface {
+	// Stats returns the connection pool statistics.
+	Stats() sql.DBStats
+}
+
 // RowStreamer iterates over query results.
 // It is designed to be memory-efficient and stream-oriented.
 type RowStreamer interface {
@@ -42,3 +49,18 @@ type RowStreamer interface {
 	// Close closes the streamer and frees resources.
 	Close() error
 }
+
+// Open returns the driver with the given name ("mysql", "postgres" or "mongo")
+// for dsn. The connection is established on first use.
+func Open(name, dsn string) (Driver, error) {
+	switch name {
+	case "mysql":
+		return NewMySQLDriver(dsn), nil
+	case "postgres":
+		return NewPostgresDriver(dsn), nil
+	case "mongo":
+		return NewMongoDriver(dsn), nil
+	default:
+		return nil, fmt.Errorf("unknown driver %q", name)
+	}
+}
@@ -49,6 +49,13 @@ func (d *MySQLDriver) Query(ctx context.Context, query string) (RowStreamer, err
 	return rows, nil
 }
 
+func (d *MySQLDriver) Stats() sql.DBStats {
+	if d.db == nil {
+		return sql.DBStats{}
+	}
+	return d.db.Stats()
+}
+
 func (d *MySQLDriver) Close() error {
 	if d.db != nil {
 		return d.db.Close()
@@ -49,6 +49,13 @@ func (d *PostgresDriver) Query(ctx context.Context, query string) (RowStreamer,
 	return rows, nil
 }
 
+func (d *PostgresDriver) Stats() sql.DBStats {
+	if d.db == nil {
+		return sql.DBStats{}
+	}
+	return d.db.Stats()
+}
+
 func (d *PostgresDriver) Close() error {
 	if d.db != nil {
 		return d.db.Close()
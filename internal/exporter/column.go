@@ -0,0 +1,192 @@
+package exporter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column describes a result column as reported by the database driver.
+// Encoders that know the column types can emit proper numbers, dates and
+// binary values instead of guessing from whatever the driver returned.
+type Column struct {
+	Name string
+	// DatabaseType is the driver's type name, e.g. "DECIMAL", "VARCHAR", "INT8".
+	DatabaseType string
+	Nullable     bool
+	// Precision and Scale are set for decimal columns, Length for variable
+	// length text and binary columns. Zero means unknown.
+	Precision int64
+	Scale     int64
+	Length    int64
+}
+
+// Kind is the family of values a column holds.
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindInteger
+	KindDecimal
+	KindFloat
+	KindBool
+	KindDate
+	KindDateTime
+	KindBinary
+)
+
+// Kind classifies the column by its database type name. Unknown types,
+// including MySQL TIME which can exceed 24 hours, are treated as strings.
+func (c Column) Kind() Kind {
+	t := strings.TrimPrefix(strings.ToUpper(c.DatabaseType), "UNSIGNED ")
+	switch t {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "INTEGER", "BIGINT", "YEAR",
+		"INT2", "INT4", "INT8", "SERIAL", "BIGSERIAL":
+		return KindInteger
+	case "DECIMAL", "NUMERIC":
+		return KindDecimal
+	case "FLOAT", "DOUBLE", "REAL", "FLOAT4", "FLOAT8":
+		return KindFloat
+	case "BOOL", "BOOLEAN":
+		return KindBool
+	case "DATE":
+		return KindDate
+	case "DATETIME", "TIMESTAMP", "TIMESTAMPTZ":
+		return KindDateTime
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "BIT", "BYTEA":
+		return KindBinary
+	default:
+		return KindString
+	}
+}
+
+// Decimal is an exact decimal number kept in its textual form, so no precision
+// is lost on the way through. It is written to JSON as a number.
+type Decimal string
+
+// decimalSyntax matches the decimals that are valid JSON numbers as they are.
+// NaN, Infinity and the like stay strings.
+var decimalSyntax = regexp.MustCompile(`^-?\d+(\.\d+)?([eE][+-]?\d+)?$`)
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if !decimalSyntax.MatchString(string(d)) {
+		return json.Marshal(string(d))
+	}
+	return []byte(d), nil
+}
+
+// dateTimeLayouts are the textual forms drivers return dates in when they do not parse them.
+var dateTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	time.DateOnly,
+}
+
+// Normalize converts a raw driver value to the Go type matching the column:
+// int64 (or uint64 past its range), Decimal, float64, bool, time.Time, []byte
+// for binary columns and string for everything else. Values that do not parse
+// are passed on as strings rather than dropped.
+func (c Column) Normalize(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	kind := c.Kind()
+	if kind == KindBinary {
+		if s, ok := v.(string); ok {
+			return []byte(s)
+		}
+		return v
+	}
+
+	var s string
+	switch val := v.(type) {
+	case []byte:
+		s = string(val)
+	case string:
+		s = val
+	case int64:
+		if kind == KindBool {
+			return val != 0
+		}
+		return v
+	default:
+		return v // already typed by the driver
+	}
+
+	switch kind {
+	case KindInteger:
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return u
+		}
+	case KindDecimal:
+		if decimalSyntax.MatchString(s) {
+			return Decimal(s)
+		}
+	case KindFloat:
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case KindBool:
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case KindDate, KindDateTime:
+		for _, layout := range dateTimeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t
+			}
+		}
+	}
+	return s
+}
+
+// formatTyped renders a normalized value as text for formats without native
+// types. ok is false if v needs no special treatment.
+func (c Column) formatTyped(v interface{}) (s string, ok bool) {
+	switch val := v.(type) {
+	case time.Time:
+		if c.Kind() == KindDate {
+			return val.Format(time.DateOnly), true
+		}
+		return val.Format("2006-01-02 15:04:05"), true
+	case []byte:
+		return base64.StdEncoding.EncodeToString(val), true
+	case Decimal:
+		return string(val), true
+	case uint64:
+		return strconv.FormatUint(val, 10), true
+	}
+	return "", false
+}
+
+// SchemaWriter is implemented by encoders that make use of column types.
+type SchemaWriter interface {
+	// WriteSchema is called instead of WriteHeader when the column types are known.
+	WriteSchema(columns []Column) error
+}
+
+// WriteSchema writes the header of enc, passing the column types along if
+// the encoder can use them.
+func WriteSchema(enc RowEncoder, columns []Column) error {
+	if sw, ok := enc.(SchemaWriter); ok {
+		return sw.WriteSchema(columns)
+	}
+	return enc.WriteHeader(ColumnNames(columns))
+}
+
+// ColumnNames returns the names of the given columns.
+func ColumnNames(columns []Column) []string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name
+	}
+	return names
+}
@@ -0,0 +1,42 @@
+package exporter
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNormalizeDecimal(t *testing.T) {
+	c := Column{Name: "amount", DatabaseType: "NUMERIC"}
+	tests := []struct {
+		raw  string
+		want interface{}
+	}{
+		{"12.50", Decimal("12.50")},
+		{"-3", Decimal("-3")},
+		{"1.5E+10", Decimal("1.5E+10")},
+		{"12345678901234567890.123456789", Decimal("12345678901234567890.123456789")},
+		// Parse as floats, but are no JSON numbers
+		{"NaN", "NaN"},
+		{"Infinity", "Infinity"},
+		{"-Inf", "-Inf"},
+		{"0x1p-2", "0x1p-2"},
+		{"1_000", "1_000"},
+		{".5", ".5"},
+		{"+1", "+1"},
+	}
+	for _, tt := range tests {
+		if got := c.Normalize([]byte(tt.raw)); got != tt.want {
+			t.Errorf("Normalize(%q) = %#v, want %#v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestDecimalMarshalJSON(t *testing.T) {
+	data, err := json.Marshal([]Decimal{"12.50", "-1e-3", "NaN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `[12.50,-1e-3,"NaN"]`; got != want {
+		t.Errorf("json.Marshal = %s, want %s", got, want)
+	}
+}
@@ -14,6 +14,7 @@ type CSVEncoder struct {
 	w       *csv.Writer
 	buf     *bufio.Writer
 	columns []string
+	types   []Column // nil unless written with WriteSchema
 }
 
 // NewCSVEncoder creates a new CSV encoder that writes to the provided io.Writer.
@@ -33,12 +34,22 @@ func (e *CSVEncoder) WriteHeader(columns []string) error {
 	return e.w.Write(columns)
 }
 
+// WriteSchema writes the header row and formats later rows by column type.
+func (e *CSVEncoder) WriteSchema(columns []Column) error {
+	e.types = columns
+	return e.WriteHeader(ColumnNames(columns))
+}
+
 // WriteRow writes a single row of values, defined as interface{} to handle SQL driver types.
 // It converts types to string efficiently without fmt.Sprintf.
 func (e *CSVEncoder) WriteRow(values []interface{}) error {
 	record := make([]string, len(values)) // Re-using this buffer would be an optimization, but encoding/csv copies anyway.
 
 	for i, v := range values {
+		if i < len(e.types) {
+			record[i] = typedString(e.types[i], v)
+			continue
+		}
 		record[i] = toString(v)
 	}
 
@@ -65,6 +76,24 @@ func (e *CSVEncoder) Close() error {
 }
 
 func toString(val interface{}) string {
+	return escapeFormula(formatValue(val))
+}
+
+// typedString formats v according to its column type. Numbers, dates and
+// base64-encoded binary cannot start a formula, so only text is escaped.
+func typedString(col Column, val interface{}) string {
+	val = col.Normalize(val)
+	s, ok := col.formatTyped(val)
+	if !ok {
+		s = formatValue(val)
+	}
+	if _, text := val.(string); text {
+		return escapeFormula(s)
+	}
+	return s
+}
+
+func formatValue(val interface{}) string {
 	var s string
 	if val == nil {
 		s = "NULL"
@@ -92,7 +121,10 @@ func toString(val interface{}) string {
 			s = ""
 		}
 	}
+	return s
+}
 
+func escapeFormula(s string) string {
 	// Formula Injection Mitigation (CSV Injection)
 	// If the string starts with =, +, -, or @, prefix it with a single quote.
 	if len(s) > 0 {
@@ -25,3 +25,30 @@ type RowEncoder interface {
 	// For Excel, this might write the central directory/zip footer.
 	io.Closer
 }
+
+// NewEncoder returns the encoder for the given export format ("csv", "json",
+// "excel" or "pdf"), writing to w. Unknown formats fall back to CSV.
+func NewEncoder(format string, w io.Writer) RowEncoder {
+	switch format {
+	case "json":
+		return NewJSONEncoder(w)
+	case "excel":
+		return NewExcelEncoder(w)
+	case "pdf":
+		return NewPDFEncoder(w)
+	default:
+		return NewCSVEncoder(w)
+	}
+}
+
+// Extension returns the file extension for the given export format.
+func Extension(format string) string {
+	switch format {
+	case "json", "pdf":
+		return format
+	case "excel":
+		return "xlsx"
+	default:
+		return "csv"
+	}
+}
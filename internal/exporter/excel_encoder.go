@@ -1,8 +1,10 @@
 package exporter
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
+	"strconv"
 
 	"github.com/xuri/excelize/v2"
 )
@@ -17,6 +19,7 @@ type ExcelEncoder struct {
 	rowIdx       int
 	err          error
 	headerLength int
+	types        []Column // nil unless written with WriteSchema
 }
 
 // NewExcelEncoder creates a new Excel encoder.
@@ -64,6 +67,12 @@ func (e *ExcelEncoder) WriteHeader(columns []string) error {
 	return nil
 }
 
+// WriteSchema writes the header row and stores later rows as typed cells.
+func (e *ExcelEncoder) WriteSchema(columns []Column) error {
+	e.types = columns
+	return e.WriteHeader(ColumnNames(columns))
+}
+
 func (e *ExcelEncoder) WriteRow(values []interface{}) error {
 	if e.err != nil {
 		return e.err
@@ -72,6 +81,11 @@ func (e *ExcelEncoder) WriteRow(values []interface{}) error {
 	// Excelize StreamWriter requires interface{} slice
 	row := make([]interface{}, len(values))
 	for i, v := range values {
+		if i < len(e.types) {
+			row[i] = excelValue(e.types[i], v)
+			continue
+		}
+
 		var s string
 		switch val := v.(type) {
 		case []byte:
@@ -120,6 +134,25 @@ func (e *ExcelEncoder) WriteRow(values []interface{}) error {
 	return nil
 }
 
+// excelValue converts v to a native cell value. Decimals become floats since
+// Excel cannot hold more than 15 significant digits anyway.
+func excelValue(col Column, v interface{}) interface{} {
+	v = col.Normalize(v)
+	switch val := v.(type) {
+	case Decimal:
+		if f, err := strconv.ParseFloat(string(val), 64); err == nil {
+			return f
+		}
+		return string(val)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(val)
+	case string:
+		return escapeFormula(val)
+	default:
+		return v
+	}
+}
+
 func (e *ExcelEncoder) Flush() error {
 	if e.err != nil {
 		return e.err
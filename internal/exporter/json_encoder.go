@@ -3,6 +3,7 @@ package exporter
 import (
 	"encoding/json"
 	"io"
+	"time"
 )
 
 // JSONEncoder implements RowEncoder for JSON Lines format.
@@ -10,6 +11,7 @@ import (
 type JSONEncoder struct {
 	w       io.Writer
 	columns []string
+	types   []Column // nil unless written with WriteSchema
 	err     error
 }
 
@@ -25,6 +27,14 @@ func (e *JSONEncoder) WriteHeader(columns []string) error {
 	return nil
 }
 
+// WriteSchema captures the column names and types. Typed rows keep numbers,
+// decimals and booleans as JSON numbers and booleans, write dates as
+// "2006-01-02" and binary values as base64.
+func (e *JSONEncoder) WriteSchema(columns []Column) error {
+	e.types = columns
+	return e.WriteHeader(ColumnNames(columns))
+}
+
 func (e *JSONEncoder) WriteRow(values []interface{}) error {
 	if e.err != nil {
 		return e.err
@@ -38,6 +48,11 @@ func (e *JSONEncoder) WriteRow(values []interface{}) error {
 			colName = e.columns[i]
 		}
 
+		if i < len(e.types) {
+			rowMap[colName] = jsonValue(e.types[i], v)
+			continue
+		}
+
 		// Some types might need special handling for JSON (like []byte)
 		if b, ok := v.([]byte); ok {
 			rowMap[colName] = string(b)
@@ -66,6 +81,14 @@ func (e *JSONEncoder) WriteRow(values []interface{}) error {
 	return nil
 }
 
+func jsonValue(col Column, v interface{}) interface{} {
+	v = col.Normalize(v)
+	if t, ok := v.(time.Time); ok && col.Kind() == KindDate {
+		return t.Format(time.DateOnly)
+	}
+	return v // []byte is marshalled as base64
+}
+
 func (e *JSONEncoder) Flush() error {
 	return nil
 }
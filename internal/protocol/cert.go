@@ -0,0 +1,10 @@
+package protocol
+
+import "strconv"
+
+// AgentCertName is the common name of the client certificate issued to the
+// agent with the given API key ID. The Reactor only accepts a certificate
+// together with the key it was issued for.
+func AgentCertName(keyID int) string {
+	return "agent-" + strconv.Itoa(keyID)
+}
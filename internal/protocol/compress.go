@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Frame payload compression algorithms, as offered in Hello and chosen in HelloAck.
+const (
+	CompressionNone = ""
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// Compressions lists the algorithms this build supports, in order of preference.
+var Compressions = []string{CompressionZstd, CompressionGzip}
+
+// Frame flags describing how the payload is encoded.
+const (
+	FlagZstd byte = 1 << iota
+	FlagGzip
+)
+
+// MaxPayloadSize bounds the decompressed size of a frame payload so a corrupt
+// or hostile frame cannot exhaust memory.
+const MaxPayloadSize = 64 << 20
+
+// MinCompressSize is the payload size below which frames are sent uncompressed;
+// small control frames do not shrink enough to be worth it.
+const MinCompressSize = 512
+
+var ErrPayloadTooLarge = errors.New("frame payload exceeds maximum size")
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxPayloadSize))
+)
+
+// NegotiateCompression picks the first offered algorithm this build supports,
+// or CompressionNone if there is none.
+func NegotiateCompression(offered []string) string {
+	for _, c := range offered {
+		if flagFor(c) != 0 {
+			return c
+		}
+	}
+	return CompressionNone
+}
+
+func flagFor(compression string) byte {
+	switch compression {
+	case CompressionZstd:
+		return FlagZstd
+	case CompressionGzip:
+		return FlagGzip
+	default:
+		return 0
+	}
+}
+
+func compress(compression string, payload []byte) ([]byte, error) {
+	switch compression {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(payload, nil), nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+func decompress(flags byte, payload []byte) ([]byte, error) {
+	switch {
+	case flags&FlagZstd != 0:
+		return zstdDecoder.DecodeAll(payload, nil)
+	case flags&FlagGzip != 0:
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		data, err := io.ReadAll(io.LimitReader(zr, MaxPayloadSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > MaxPayloadSize {
+			return nil, ErrPayloadTooLarge
+		}
+		return data, nil
+	default:
+		return payload, nil
+	}
+}
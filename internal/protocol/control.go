@@ -0,0 +1,96 @@
+// Package protocol defines the messages exchanged between the Reactor and its agents.
+package protocol
+
+import "time"
+
+// Liveness timings shared by both ends of the control socket.
+const (
+	// PingInterval is how often the Reactor pings an agent's control socket.
+	PingInterval = 30 * time.Second
+	// PongWait is how long either side waits for any frame before treating
+	// the connection as dead. It must exceed PingInterval.
+	PongWait = 60 * time.Second
+	// HeartbeatInterval is how often an agent reports its load.
+	HeartbeatInterval = 15 * time.Second
+	// HeartbeatTimeout is how long the Reactor keeps an agent registered
+	// without hearing from it.
+	HeartbeatTimeout = 3 * HeartbeatInterval
+)
+
+// Control message types sent on /agent/control.
+const (
+	// TypeHello is sent by the agent right after connecting to describe itself.
+	TypeHello = "hello"
+	// TypeHeartbeat is sent periodically by the agent with its current load.
+	TypeHeartbeat = "heartbeat"
+	// TypeJobStatus is sent by the agent when a job is queued, started or rejected.
+	TypeJobStatus = "job_status"
+	// TypeDraining is sent by the agent when it starts shutting down: it
+	// accepts no more jobs and finishes the running ones.
+	TypeDraining = "draining"
+	// TypeJob asks the agent to run a query and stream the result to /agent/data.
+	TypeJob = "job"
+	// TypeCancel asks the agent to stop a running job and close its data stream.
+	TypeCancel = "cancel"
+	// TypeUpdate is sent by the Reactor after the hello of an agent whose
+	// version differs from the latest release, named in Version. Agents
+	// configured to update themselves download and verify it before switching.
+	TypeUpdate = "update"
+)
+
+// Job statuses reported in TypeJobStatus messages.
+const (
+	JobQueued   = "queued"
+	JobStarted  = "started"
+	JobRejected = "rejected"
+)
+
+// ControlMessage is the JSON envelope sent over the agent control socket.
+// Fields not relevant to a message type are omitted.
+type ControlMessage struct {
+	Type  string `json:"type"`
+	JobID string `json:"id,omitempty"`
+	Query string `json:"query,omitempty"`
+	// Source names the data source a job runs against. Empty selects the
+	// agent's default source.
+	Source string `json:"source,omitempty"`
+
+	// Hello. Driver is the driver of the default source, for Reactors that
+	// predate named sources. Version is also the release advertised by an update.
+	Driver   string       `json:"driver,omitempty"`
+	Version  string       `json:"version,omitempty"`
+	Hostname string       `json:"hostname,omitempty"`
+	Sources  []SourceInfo `json:"sources,omitempty"`
+
+	// Heartbeat, job status
+	Load *AgentLoad `json:"load,omitempty"`
+
+	// Job status
+	Status string `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SourceInfo describes a data source an agent serves.
+type SourceInfo struct {
+	Name   string `json:"name"`
+	Driver string `json:"driver"`
+}
+
+// AgentLoad is the resource usage an agent reports with each heartbeat.
+type AgentLoad struct {
+	RunningJobs       int   `json:"running_jobs"`
+	QueuedJobs        int   `json:"queued_jobs"`
+	MaxJobs           int   `json:"max_jobs"`
+	QueueSize         int   `json:"queue_size"`
+	DBOpenConnections int   `json:"db_open_connections"`
+	DBInUse           int   `json:"db_in_use"`
+	DBIdle            int   `json:"db_idle"`
+	DBWaitCount       int64 `json:"db_wait_count"`
+	// Draining is set once the agent is shutting down.
+	Draining bool `json:"draining,omitempty"`
+}
+
+// Saturated reports whether the agent can neither start nor queue another job.
+func (l *AgentLoad) Saturated() bool {
+	return l != nil && l.MaxJobs > 0 && l.RunningJobs >= l.MaxJobs && l.QueuedJobs >= l.QueueSize
+}
@@ -0,0 +1,41 @@
+package protocol
+
+// Trailer statuses.
+const (
+	TrailerOK    = "ok"
+	TrailerError = "error"
+)
+
+// Error classes reported in a failed StreamTrailer.
+const (
+	// ErrorClassQuery means the database rejected or failed to run the query.
+	ErrorClassQuery = "query"
+	// ErrorClassRead means reading a row from the database failed mid-stream.
+	ErrorClassRead = "read"
+	// ErrorClassEncode means the agent failed to encode a row for the wire.
+	ErrorClassEncode = "encode"
+	// ErrorClassCancelled means the job was cancelled before it finished.
+	ErrorClassCancelled = "cancelled"
+	// ErrorClassPolicy means the job exceeded a limit of the agent's local
+	// policy, e.g. its row limit or timeout.
+	ErrorClassPolicy = "policy"
+	// ErrorClassShutdown means the agent shut down before the job finished.
+	ErrorClassShutdown = "shutdown"
+	// ErrorClassSpool means the agent dropped the spooled stream of the job
+	// before it could upload it, e.g. because it expired.
+	ErrorClassSpool = "spool"
+)
+
+// StreamTrailer ends an agent data stream. It is sent as a JSON text message
+// after the last binary row message, so the Reactor can tell a finished export
+// from a failed one, and either from a stream that was cut off.
+type StreamTrailer struct {
+	Status string `json:"status"`
+	// Rows is the number of rows the agent sent.
+	Rows int64 `json:"rows"`
+	// Checksum is the hex SHA-256 of all binary payload bytes in the stream.
+	Checksum string `json:"checksum,omitempty"`
+
+	Error      string `json:"error,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+}
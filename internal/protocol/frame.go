@@ -0,0 +1,267 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Data stream protocol versions.
+//
+// Version 1 is the original unframed stream: a gob-encoded []string header,
+// one gob-encoded []interface{} per row and, since the trailer was added, a
+// JSON StreamTrailer text message. It is selected when the agent does not
+// negotiate a WebSocket subprotocol.
+//
+// Version 2 and later send one Frame per binary WebSocket message. The version
+// is negotiated with the WebSocket subprotocol and confirmed by the Hello/HelloAck
+// exchange that opens every stream.
+const (
+	LegacyVersion   = 1
+	ProtocolVersion = 2
+)
+
+// Subprotocols lists the data stream subprotocols this build supports, newest first.
+var Subprotocols = []string{"fluxquery.v2"}
+
+// SubprotocolVersion maps a negotiated subprotocol to its protocol version.
+// An empty subprotocol means the peer predates framing.
+func SubprotocolVersion(subprotocol string) int {
+	switch subprotocol {
+	case "fluxquery.v2":
+		return 2
+	default:
+		return LegacyVersion
+	}
+}
+
+func init() {
+	// Row values travel as interface{}; both ends must know the concrete types.
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]byte{})
+	gob.Register(time.Time{})
+}
+
+// FrameType identifies the payload of a data stream frame.
+type FrameType byte
+
+const (
+	// FrameHello is the first frame an agent sends (payload: Hello).
+	FrameHello FrameType = iota + 1
+	// FrameHelloAck is the Reactor's reply to Hello (payload: HelloAck).
+	FrameHelloAck
+	// FrameSchema describes the result columns (payload: Schema).
+	FrameSchema
+	// FrameRowBatch carries one or more rows (payload: RowBatch).
+	FrameRowBatch
+	// FrameProgress reports how far the agent has got (payload: Progress).
+	FrameProgress
+	// FrameError ends a failed stream (payload: StreamError).
+	FrameError
+	// FrameEnd ends a successful stream (payload: End).
+	FrameEnd
+	// FrameAck is sent by the Reactor for row batches it has stored (payload: Ack).
+	FrameAck
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameHello:
+		return "hello"
+	case FrameHelloAck:
+		return "hello_ack"
+	case FrameSchema:
+		return "schema"
+	case FrameRowBatch:
+		return "row_batch"
+	case FrameProgress:
+		return "progress"
+	case FrameError:
+		return "error"
+	case FrameEnd:
+		return "end"
+	case FrameAck:
+		return "ack"
+	default:
+		return fmt.Sprintf("frame(%d)", byte(t))
+	}
+}
+
+// frameHeaderSize is the type byte plus the flags byte.
+const frameHeaderSize = 2
+
+var ErrShortFrame = errors.New("frame shorter than header")
+
+// Frame is a single data stream message: a one-byte type, a one-byte flags
+// field describing the payload compression, and a gob-encoded payload.
+// Payload always holds the uncompressed bytes.
+type Frame struct {
+	Type    FrameType
+	Flags   byte
+	Payload []byte
+}
+
+// Hello opens a version 2+ stream. Compression lists the payload compression
+// algorithms the agent can send, in order of preference. Resume is set when the
+// agent reconnects to continue a stream whose connection dropped.
+//
+// Spool is set by agents that keep the stream on disk: if it cannot be
+// resumed, they upload it again once the Reactor is reachable, as a new stream
+// with Spooled set that starts over from the schema.
+type Hello struct {
+	Version      int
+	AgentVersion string
+	JobID        string
+	Compression  []string
+	Resume       bool
+	Spool        bool
+	Spooled      bool
+}
+
+// HelloAck confirms the protocol version the Reactor will speak and the
+// compression the agent may use, CompressionNone if none of the offered ones.
+//
+// Window is the number of row batches the agent may send before it has to wait
+// for an Ack. Each Ack returns that many credits. Zero disables flow control.
+//
+// Resumed confirms a resumed stream; Seq is then the last row batch the
+// Reactor has stored, and the agent continues with the batch after it.
+//
+// Spool confirms that the Reactor waits for a spooled upload when the stream
+// cannot be resumed, instead of recording the job as truncated.
+//
+// EndAck is set by Reactors that acknowledge the End or Error frame once they
+// have recorded the outcome of the stream, see Ack.
+type HelloAck struct {
+	Version     int
+	Compression string
+	Window      int
+	Resumed     bool
+	Seq         uint64
+	Spool       bool
+	EndAck      bool
+}
+
+// Schema describes the result columns. Types is empty if the driver cannot
+// report column types (e.g. MongoDB); otherwise it matches Columns one to one.
+type Schema struct {
+	Columns []string
+	Types   []ColumnType
+}
+
+// ColumnType describes a result column as reported by the database driver.
+// Nullable is true if the driver does not know. Precision, Scale and Length
+// are zero if they do not apply or are unknown.
+type ColumnType struct {
+	Name         string
+	DatabaseType string
+	Nullable     bool
+	Precision    int64
+	Scale        int64
+	Length       int64
+}
+
+// RowBatch carries consecutive rows of the result. Seq numbers the batches of
+// a stream from 1, so batches resent after a resume can be recognized.
+type RowBatch struct {
+	Seq  uint64
+	Rows [][]interface{}
+}
+
+// Progress reports the number of rows read from the database so far.
+type Progress struct {
+	Rows int64
+}
+
+// StreamError ends a stream that failed. Class is one of the ErrorClass constants.
+type StreamError struct {
+	Class   string
+	Message string
+	Rows    int64
+}
+
+// End ends a stream that completed. Checksum is the hex SHA-256 of the
+// uncompressed payloads of every schema and row batch frame, in order.
+type End struct {
+	Rows     int64
+	Checksum string
+}
+
+// NewFrame builds a frame with the gob-encoded payload v.
+func NewFrame(t FrameType, v interface{}) (Frame, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return Frame{}, fmt.Errorf("encode %s frame: %w", t, err)
+	}
+	return Frame{Type: t, Payload: buf.Bytes()}, nil
+}
+
+// Ack acknowledges row batches the Reactor has processed, allowing the agent
+// to send that many more. Seq is the last row batch stored so far; the agent
+// can forget every batch up to it.
+//
+// End acknowledges the End or Error frame: the outcome of the stream is
+// recorded, so the agent no longer needs its copy of the stream.
+type Ack struct {
+	Batches int
+	Seq     uint64
+	End     bool
+}
+
+// EncodeFrame builds the uncompressed wire form of a frame with the gob-encoded payload v.
+func EncodeFrame(t FrameType, v interface{}) ([]byte, error) {
+	f, err := NewFrame(t, v)
+	if err != nil {
+		return nil, err
+	}
+	return f.Marshal(CompressionNone)
+}
+
+// Marshal returns the wire form of the frame. Payloads of at least
+// MinCompressSize bytes are compressed with the given algorithm.
+func (f Frame) Marshal(compression string) ([]byte, error) {
+	payload := f.Payload
+	flags := f.Flags
+	if compression != CompressionNone && len(payload) >= MinCompressSize {
+		compressed, err := compress(compression, payload)
+		if err != nil {
+			return nil, fmt.Errorf("compress %s frame: %w", f.Type, err)
+		}
+		payload = compressed
+		flags |= flagFor(compression)
+	}
+
+	data := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	data[0] = byte(f.Type)
+	data[1] = flags
+	return append(data, payload...), nil
+}
+
+// DecodeFrame splits a wire message into its header and payload,
+// decompressing the payload if its flags say so.
+func DecodeFrame(data []byte) (Frame, error) {
+	if len(data) < frameHeaderSize {
+		return Frame{}, ErrShortFrame
+	}
+	f := Frame{
+		Type:  FrameType(data[0]),
+		Flags: data[1],
+	}
+	payload, err := decompress(f.Flags, data[frameHeaderSize:])
+	if err != nil {
+		return Frame{}, fmt.Errorf("decompress %s frame: %w", f.Type, err)
+	}
+	f.Payload = payload
+	return f, nil
+}
+
+// Decode unmarshals the frame payload into v.
+func (f Frame) Decode(v interface{}) error {
+	if err := gob.NewDecoder(bytes.NewReader(f.Payload)).Decode(v); err != nil {
+		return fmt.Errorf("decode %s frame: %w", f.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	batch := RowBatch{Rows: [][]interface{}{
+		{int64(1), "alice", 3.5, []byte{0, 1, 2}, time.Date(2024, 2, 29, 12, 30, 0, 0, time.UTC), nil},
+		{int64(-2), strings.Repeat("long text ", 200), true, map[string]interface{}{"a": "b"}, []interface{}{"x", int64(3)}, nil},
+	}}
+
+	for _, compression := range []string{CompressionNone, CompressionZstd, CompressionGzip} {
+		t.Run("compression="+compression, func(t *testing.T) {
+			frame, err := NewFrame(FrameRowBatch, batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := frame.Marshal(compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := flagFor(compression); data[1] != want {
+				t.Errorf("flags = %#x, want %#x", data[1], want)
+			}
+			if compression != CompressionNone && len(data) >= frameHeaderSize+len(frame.Payload) {
+				t.Errorf("compressed frame is %d bytes, payload %d", len(data), len(frame.Payload))
+			}
+
+			decoded, err := DecodeFrame(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Type != FrameRowBatch {
+				t.Errorf("type = %s, want %s", decoded.Type, FrameRowBatch)
+			}
+			// The checksum covers the uncompressed payload, so it must survive as is
+			if !bytes.Equal(decoded.Payload, frame.Payload) {
+				t.Fatal("payload changed in the round trip")
+			}
+			var got RowBatch
+			if err := decoded.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, batch) {
+				t.Fatalf("decoded %#v, want %#v", got, batch)
+			}
+		})
+	}
+}
+
+func TestFrameSmallPayloadUncompressed(t *testing.T) {
+	frame, err := NewFrame(FrameProgress, Progress{Rows: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Payload) >= MinCompressSize {
+		t.Fatalf("progress payload is %d bytes, not small", len(frame.Payload))
+	}
+	data, err := frame.Marshal(CompressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[1] != 0 {
+		t.Fatalf("small frame has flags %#x, want none", data[1])
+	}
+
+	decoded, err := DecodeFrame(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress Progress
+	if err := decoded.Decode(&progress); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Rows != 42 {
+		t.Fatalf("decoded %+v", progress)
+	}
+}
+
+func TestEncodeFrame(t *testing.T) {
+	data, err := EncodeFrame(FrameHello, Hello{Version: ProtocolVersion, JobID: "job", Compression: Compressions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[1] != 0 {
+		t.Fatalf("EncodeFrame set flags %#x, want none", data[1])
+	}
+	frame, err := DecodeFrame(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hello Hello
+	if err := frame.Decode(&hello); err != nil {
+		t.Fatal(err)
+	}
+	if hello.JobID != "job" || !reflect.DeepEqual(hello.Compression, Compressions) {
+		t.Fatalf("decoded %+v", hello)
+	}
+}
+
+func TestDecodeFrameInvalid(t *testing.T) {
+	if _, err := DecodeFrame([]byte{byte(FrameEnd)}); !errors.Is(err, ErrShortFrame) {
+		t.Errorf("one byte frame: %v, want %v", err, ErrShortFrame)
+	}
+	for _, flag := range []byte{FlagZstd, FlagGzip} {
+		if _, err := DecodeFrame([]byte{byte(FrameRowBatch), flag, 1, 2, 3}); err == nil {
+			t.Errorf("corrupt payload with flags %#x decoded", flag)
+		}
+	}
+
+	// A small frame must not decompress beyond MaxPayloadSize
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(make([]byte, MaxPayloadSize+1))
+	zw.Close()
+	bomb := append([]byte{byte(FrameRowBatch), FlagGzip}, buf.Bytes()...)
+	if _, err := DecodeFrame(bomb); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("oversized gzip payload: %v, want %v", err, ErrPayloadTooLarge)
+	}
+
+	frame := Frame{Type: FrameEnd, Payload: []byte("not gob")}
+	if err := frame.Decode(&End{}); err == nil {
+		t.Error("invalid payload decoded")
+	}
+}
+
+func TestSubprotocolVersion(t *testing.T) {
+	for _, subprotocol := range Subprotocols {
+		if got := SubprotocolVersion(subprotocol); got != ProtocolVersion {
+			t.Errorf("SubprotocolVersion(%q) = %d, want %d", subprotocol, got, ProtocolVersion)
+		}
+	}
+	if got := SubprotocolVersion(""); got != LegacyVersion {
+		t.Errorf("SubprotocolVersion(\"\") = %d, want %d", got, LegacyVersion)
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{nil, CompressionNone},
+		{[]string{"brotli"}, CompressionNone},
+		{[]string{"brotli", CompressionGzip, CompressionZstd}, CompressionGzip},
+		{Compressions, CompressionZstd},
+	}
+	for _, tt := range tests {
+		if got := NegotiateCompression(tt.offered); got != tt.want {
+			t.Errorf("NegotiateCompression(%q) = %q, want %q", tt.offered, got, tt.want)
+		}
+	}
+}
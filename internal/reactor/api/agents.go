@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"mysql-exporter/internal/reactor/hub"
+)
+
+// AgentStatus describes one of the user's API keys and the agent connected with it, if any.
+type AgentStatus struct {
+	ID         int            `json:"id"`
+	KeyPrefix  string         `json:"key_prefix"`
+	Type       string         `json:"type"`
+	Online     bool           `json:"online"`
+	Connection *hub.AgentInfo `json:"connection,omitempty"`
+}
+
+// HandleListAgents lists the authenticated user's agents and whether each is online.
+func (h *Handler) HandleListAgents(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid user", http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := h.Store.ListAPIKeys(userID)
+	if err != nil {
+		slog.Error("List agents failed", "error", err)
+		http.Error(w, "Failed to list agents", http.StatusInternalServerError)
+		return
+	}
+
+	agents := make([]AgentStatus, 0, len(keys))
+	for _, key := range keys {
+		status := AgentStatus{
+			ID:        key.ID,
+			KeyPrefix: key.KeyPrefix,
+			Type:      key.Type,
+		}
+		if conn, ok := h.Hub.Agent(key.ID); ok {
+			info := conn.Info()
+			status.Online = true
+			status.Connection = &info
+		}
+		agents = append(agents, status)
+	}
+
+	json.NewEncoder(w).Encode(agents)
+}
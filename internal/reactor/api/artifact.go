@@ -0,0 +1,133 @@
+package api
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"mysql-exporter/internal/exporter"
+	"mysql-exporter/internal/protocol"
+	"mysql-exporter/internal/reactor/store"
+)
+
+// artifact writes the rows of a job to storage in the job's format, through the
+// same pipeline worker.Pool uses: Encoder -> [Gzip?] -> Storage.
+type artifact struct {
+	Key string
+
+	encoder exporter.RowEncoder
+	gzip    *gzip.Writer
+	storage io.WriteCloser
+	errChan <-chan error
+	cancel  context.CancelFunc
+	closed  bool
+}
+
+// newArtifact starts uploading the export of job to storage.
+func (h *Handler) newArtifact(job *store.Job) (*artifact, error) {
+	key := fmt.Sprintf("exports/%s.%s", job.ID, exporter.Extension(job.Format))
+	if h.UseGzip {
+		key += ".gz"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	storageWriter, errChan := h.Storage.StreamToFile(ctx, key)
+	if storageWriter == nil {
+		cancel()
+		return nil, <-errChan
+	}
+
+	a := &artifact{
+		Key:     key,
+		storage: storageWriter,
+		errChan: errChan,
+		cancel:  cancel,
+	}
+
+	var w io.Writer = storageWriter
+	if h.UseGzip {
+		a.gzip = gzip.NewWriter(storageWriter)
+		w = a.gzip
+	}
+	a.encoder = exporter.NewEncoder(job.Format, w)
+	return a, nil
+}
+
+func (a *artifact) WriteHeader(columns []string) error {
+	return a.encoder.WriteHeader(columns)
+}
+
+// WriteSchema writes the header of a schema frame, passing the column types
+// to the encoder when the agent sent them.
+func (a *artifact) WriteSchema(schema protocol.Schema) error {
+	if len(schema.Types) != len(schema.Columns) {
+		return a.encoder.WriteHeader(schema.Columns)
+	}
+	return exporter.WriteSchema(a.encoder, schemaColumns(schema.Types))
+}
+
+func (a *artifact) WriteRow(values []interface{}) error {
+	return a.encoder.WriteRow(values)
+}
+
+// Close finishes the file and waits for the upload to complete.
+func (a *artifact) Close() error {
+	a.closed = true
+	defer a.cancel()
+
+	encoderCloseErr := a.encoder.Close()
+	var gzipCloseErr error
+	if a.gzip != nil {
+		gzipCloseErr = a.gzip.Close()
+	}
+	storageCloseErr := a.storage.Close()
+	uploadErr := <-a.errChan
+
+	if encoderCloseErr != nil {
+		return fmt.Errorf("encoder close failed: %w", encoderCloseErr)
+	}
+	if gzipCloseErr != nil {
+		return fmt.Errorf("gzip close failed: %w", gzipCloseErr)
+	}
+	if storageCloseErr != nil {
+		return fmt.Errorf("storage close failed: %w", storageCloseErr)
+	}
+	if uploadErr != nil {
+		return fmt.Errorf("upload failed: %w", uploadErr)
+	}
+	return nil
+}
+
+var errExportAborted = errors.New("export aborted")
+
+// Abort stops the upload of an export that will not complete. Providers that
+// write as they go (e.g. local storage) may leave a partial file behind.
+// It does nothing once the artifact was closed.
+func (a *artifact) Abort() {
+	if a.closed {
+		return
+	}
+	a.closed = true
+	a.cancel()
+	// Fail the upload instead of letting it finish with the partial data
+	if pw, ok := a.storage.(*io.PipeWriter); ok {
+		pw.CloseWithError(errExportAborted)
+	} else {
+		a.storage.Close()
+	}
+	<-a.errChan
+	slog.Info("Discarded partial export", "key", a.Key)
+}
+
+// schemaColumns converts the column types of a schema frame for the encoders.
+// exporter.Column mirrors protocol.ColumnType.
+func schemaColumns(types []protocol.ColumnType) []exporter.Column {
+	columns := make([]exporter.Column, len(types))
+	for i, t := range types {
+		columns[i] = exporter.Column(t)
+	}
+	return columns
+}
@@ -0,0 +1,381 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"mysql-exporter/internal/protocol"
+	"mysql-exporter/internal/reactor/hub"
+	"mysql-exporter/internal/reactor/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// dataUpgrader offers the framed data stream subprotocols. Agents that do not
+// ask for one get no subprotocol and speak the legacy stream.
+var dataUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    protocol.Subprotocols,
+	CheckOrigin: func(r *http.Request) bool {
+		return true // Allow all for now
+	},
+}
+
+// HandleData accepts the data stream of a job from the agent it was dispatched to.
+func (h *Handler) HandleData(w http.ResponseWriter, r *http.Request) {
+	apiKey := h.authenticateAgent(w, r)
+	if apiKey == nil {
+		return
+	}
+
+	jobID := r.URL.Query().Get("job_id")
+	job, err := h.Store.GetJob(jobID)
+	if err != nil {
+		slog.Warn("Data stream for unknown job", "job_id", jobID, "key_id", apiKey.ID, "error", err)
+		http.Error(w, "Unknown job", http.StatusNotFound)
+		return
+	}
+	// Jobs of other agents are reported as unknown, so they cannot be probed
+	if job.AgentKeyID != apiKey.ID {
+		slog.Warn("Data stream for job of another agent", "job_id", jobID, "key_id", apiKey.ID, "agent_id", job.AgentKeyID)
+		http.Error(w, "Unknown job", http.StatusNotFound)
+		return
+	}
+	if job.Status.IsTerminal() {
+		slog.Warn("Data stream for finished job", "job_id", jobID, "status", job.Status)
+		http.Error(w, "Job is no longer active", http.StatusConflict)
+		return
+	}
+
+	conn, err := dataUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("Upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	version := protocol.SubprotocolVersion(conn.Subprotocol())
+	slog.Info("Agent Connected (Data Stream)", "job_id", jobID, "key_id", apiKey.ID, "protocol", version)
+
+	// A reconnecting agent replaces a connection that may not have noticed it dropped
+	if old, loaded := h.streams.Swap(jobID, conn); loaded {
+		old.(*websocket.Conn).Close()
+	}
+	defer h.streams.CompareAndDelete(jobID, conn)
+
+	if version == protocol.LegacyVersion {
+		h.readLegacyStream(conn, job)
+		return
+	}
+	h.readFramedStream(conn, job)
+}
+
+// startExport marks the job running once its header arrived and opens the
+// export file. On failure the job is failed and nil is returned.
+func (h *Handler) startExport(job *store.Job, bytes int64) *artifact {
+	if err := h.Store.MarkJobRunning(job.ID); err != nil {
+		logTransitionError("Failed to mark job running", job.ID, err)
+	}
+
+	art, err := h.newArtifact(job)
+	if err != nil {
+		slog.Error("Failed to start export", "job_id", job.ID, "error", err)
+		h.failJob(job.ID, 0, bytes, fmt.Sprintf("failed to start export: %v", err))
+		return nil
+	}
+	return art
+}
+
+// readLegacyStream ingests a version 1 stream: gob-encoded columns and rows
+// followed by a JSON trailer.
+func (h *Handler) readLegacyStream(conn *websocket.Conn, job *store.Job) {
+	jobID := job.ID
+	reader := NewWSReader(conn)
+	dec := gob.NewDecoder(reader)
+
+	// 1. Read Columns (a failed query sends its trailer straight away)
+	var columns []string
+	if err := dec.Decode(&columns); err != nil {
+		if reader.Trailer != nil {
+			h.finishJob(jobID, 0, reader, nil)
+			return
+		}
+		slog.Error("Failed to decode columns", "error", err)
+		h.failJob(jobID, 0, reader.BytesRead(), fmt.Sprintf("failed to decode columns: %v", err))
+		return
+	}
+	slog.Info("Received Schema", "columns", columns)
+
+	art := h.startExport(job, reader.BytesRead())
+	if art == nil {
+		return
+	}
+	defer art.Abort()
+
+	if err := art.WriteHeader(columns); err != nil {
+		h.failJob(jobID, 0, reader.BytesRead(), fmt.Sprintf("failed to write header: %v", err))
+		return
+	}
+
+	// 2. Read Rows until the trailer or the connection ends
+	var rowCount int64
+	closed, err := readLegacyRows(jobID, dec, reader, func(values []interface{}) error {
+		if err := art.WriteRow(values); err != nil {
+			return err
+		}
+		rowCount++
+
+		if rowCount%10 == 0 {
+			h.Hub.Broadcast(hub.DashboardUpdate{
+				Type:  "progress",
+				JobID: jobID,
+				Rows:  int(rowCount),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		h.failJob(jobID, rowCount, reader.BytesRead(), fmt.Sprintf("failed to write row: %v", err))
+		return
+	}
+
+	if reader.Trailer == nil && closed && h.predatesTrailers(job.AgentKeyID) {
+		// Such agents end every stream by closing it, so it is all there is
+		slog.Info("Data Stream closed by an agent without trailers", "job_id", jobID)
+		h.completeJob(jobID, rowCount, reader.BytesRead(), art)
+		return
+	}
+	h.finishJob(jobID, rowCount, reader, art)
+}
+
+// readLegacyRows decodes the rows of a version 1 stream and passes them to
+// row, until the trailer or the end of the connection. It reports whether the
+// connection was closed between two rows, as opposed to a row being cut off or
+// garbled. An error is only returned by row.
+func readLegacyRows(jobID string, dec *gob.Decoder, reader *WSReader, row func([]interface{}) error) (closed bool, err error) {
+	for {
+		start := reader.BytesRead()
+		var values []interface{}
+		if err := dec.Decode(&values); err != nil {
+			if reader.Trailer == nil {
+				slog.Info("Stream ended", "job_id", jobID, "reason", err)
+			}
+			return reader.connErr != nil && reader.BytesRead() == start, nil
+		}
+		if err := row(values); err != nil {
+			return false, err
+		}
+	}
+}
+
+// predatesTrailers reports whether the agent of a key is older than stream
+// trailers. Those agents do not announce themselves on the control connection
+// either, which is how they are told apart.
+func (h *Handler) predatesTrailers(keyID int) bool {
+	agent, ok := h.Hub.Agent(keyID)
+	return ok && !agent.Announced()
+}
+
+// finishJob records the outcome of a data stream based on its trailer.
+// art is the export being written, nil if the header never arrived.
+func (h *Handler) finishJob(jobID string, rowCount int64, reader *WSReader, art *artifact) {
+	trailer := reader.Trailer
+	bytes := reader.BytesRead()
+
+	switch {
+	case trailer == nil:
+		reason := "data stream ended without a trailer"
+		if art == nil {
+			h.failJob(jobID, rowCount, bytes, reason)
+			return
+		}
+		h.truncateJob(jobID, rowCount, bytes, reason)
+
+	case trailer.Status != protocol.TrailerOK:
+		if trailer.ErrorClass == protocol.ErrorClassCancelled {
+			h.cancelStream(jobID, rowCount)
+			return
+		}
+		h.failJob(jobID, rowCount, bytes, fmt.Sprintf("%s error: %s", trailer.ErrorClass, trailer.Error))
+
+	case trailer.Rows != rowCount:
+		h.truncateJob(jobID, rowCount, bytes, fmt.Sprintf("row count mismatch: agent sent %d, received %d", trailer.Rows, rowCount))
+
+	case trailer.Checksum != reader.Checksum():
+		h.truncateJob(jobID, rowCount, bytes, "checksum mismatch")
+
+	case art == nil:
+		h.failJob(jobID, rowCount, bytes, "data stream ended before the header")
+
+	default:
+		h.completeJob(jobID, rowCount, bytes, art)
+	}
+}
+
+// completeJob stores the export of a verified stream, records the job as
+// completed and notifies dashboards.
+func (h *Handler) completeJob(jobID string, rows, bytes int64, art *artifact) {
+	slog.Info("Data Stream Complete", "job_id", jobID, "total_rows", rows)
+	if err := art.Close(); err != nil {
+		slog.Error("Failed to store export", "job_id", jobID, "key", art.Key, "error", err)
+		h.failJob(jobID, rows, bytes, fmt.Sprintf("failed to store export: %v", err))
+		return
+	}
+
+	if err := h.Store.CompleteJob(jobID, rows, bytes, art.Key); err != nil {
+		logTransitionError("Failed to mark job completed", jobID, err)
+		return
+	}
+	h.Hub.Broadcast(hub.DashboardUpdate{
+		Type:        "job_complete",
+		JobID:       jobID,
+		Rows:        int(rows),
+		DownloadURL: h.Storage.GetDownloadURL(art.Key),
+	})
+}
+
+// cancelStream records that the agent stopped the job because it was cancelled.
+// Dashboards were already told when the cancellation was requested.
+func (h *Handler) cancelStream(jobID string, rows int64) {
+	slog.Info("Data Stream Cancelled", "job_id", jobID, "rows", rows)
+	if err := h.Store.CancelJob(jobID); err != nil {
+		logTransitionError("Failed to mark job cancelled", jobID, err)
+	}
+}
+
+// failJob records the failure and notifies dashboards.
+func (h *Handler) failJob(jobID string, rows, bytes int64, reason string) {
+	if err := h.Store.FailJob(jobID, rows, bytes, reason); err != nil {
+		logTransitionError("Failed to mark job failed", jobID, err)
+		return
+	}
+	h.Hub.Broadcast(hub.DashboardUpdate{
+		Type:   "job_failed",
+		JobID:  jobID,
+		Rows:   int(rows),
+		Status: "failed",
+	})
+}
+
+// spoolJob records that the agent kept the lost data stream on disk, so the
+// job waits for the upload instead of being truncated.
+func (h *Handler) spoolJob(jobID string, rows, bytes int64) {
+	slog.Warn("Data Stream lost, waiting for the agent to upload its spool", "job_id", jobID, "rows", rows)
+	if err := h.Store.MarkJobSpooled(jobID, rows, bytes); err != nil {
+		logTransitionError("Failed to mark job spooled", jobID, err)
+		return
+	}
+	h.Hub.Broadcast(hub.DashboardUpdate{
+		Type:   "job_spooled",
+		JobID:  jobID,
+		Rows:   int(rows),
+		Status: "spooled",
+	})
+}
+
+// truncateJob records an incomplete export and notifies dashboards.
+func (h *Handler) truncateJob(jobID string, rows, bytes int64, reason string) {
+	slog.Warn("Data Stream Truncated", "job_id", jobID, "rows", rows, "reason", reason)
+	if err := h.Store.TruncateJob(jobID, rows, bytes, reason); err != nil {
+		logTransitionError("Failed to mark job truncated", jobID, err)
+		return
+	}
+	h.Hub.Broadcast(hub.DashboardUpdate{
+		Type:   "job_failed",
+		JobID:  jobID,
+		Rows:   int(rows),
+		Status: "truncated",
+	})
+}
+
+// logTransitionError logs a failed status update. Losing a race against a
+// cancellation is expected and only logged at info level.
+func logTransitionError(msg, jobID string, err error) {
+	if errors.Is(err, store.ErrInvalidTransition) {
+		slog.Info("Job already finished", "job_id", jobID, "reason", err)
+		return
+	}
+	slog.Error(msg, "job_id", jobID, "error", err)
+}
+
+// WSReader Helper (could be moved to util if shared)
+// It presents the binary messages of a data stream as one continuous reader.
+// A text message carries the stream trailer: it is parsed into Trailer and
+// ends the stream with io.EOF.
+type WSReader struct {
+	Conn    *websocket.Conn
+	Trailer *protocol.StreamTrailer
+
+	reader  io.Reader
+	n       int64
+	hash    hash.Hash
+	connErr error // why the connection ended, if it did
+}
+
+func NewWSReader(conn *websocket.Conn) *WSReader {
+	return &WSReader{Conn: conn, hash: sha256.New()}
+}
+
+// BytesRead returns the number of payload bytes consumed so far.
+func (r *WSReader) BytesRead() int64 {
+	return r.n
+}
+
+// Checksum returns the hex SHA-256 of the payload bytes consumed so far.
+func (r *WSReader) Checksum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// ReadByte makes WSReader an io.ByteReader, so a gob.Decoder reads no further
+// than the message it decodes.
+func (r *WSReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *WSReader) Read(p []byte) (n int, err error) {
+	if r.Trailer != nil {
+		return 0, io.EOF
+	}
+
+	if r.reader == nil {
+		messageType, reader, err := r.Conn.NextReader()
+		if err != nil {
+			r.connErr = err
+			return 0, err
+		}
+		if messageType == websocket.TextMessage {
+			var trailer protocol.StreamTrailer
+			if err := json.NewDecoder(reader).Decode(&trailer); err != nil {
+				return 0, fmt.Errorf("invalid stream trailer: %w", err)
+			}
+			r.Trailer = &trailer
+			return 0, io.EOF
+		}
+		r.reader = reader
+	}
+
+	n, err = r.reader.Read(p)
+	r.n += int64(n)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		r.reader = nil
+		if n > 0 {
+			return n, nil
+		}
+		return r.Read(p) // Try next message
+	}
+	return n, err
+}
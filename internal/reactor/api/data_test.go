@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// baselineWriter is how agents from before stream trailers write their data
+// stream: every gob message in a binary message of its own.
+type baselineWriter struct {
+	conn *websocket.Conn
+}
+
+func (w baselineWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type legacyResult struct {
+	columns []string
+	rows    [][]interface{}
+	closed  bool
+	trailer *protocol.StreamTrailer
+}
+
+// replayLegacy serves one legacy data stream, written by send, and returns
+// what the Reactor read from it.
+func replayLegacy(t *testing.T, send func(conn *websocket.Conn, enc *gob.Encoder)) legacyResult {
+	t.Helper()
+	results := make(chan legacyResult, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := dataUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		var res legacyResult
+		reader := NewWSReader(conn)
+		dec := gob.NewDecoder(reader)
+		if err := dec.Decode(&res.columns); err != nil {
+			t.Errorf("decode columns: %v", err)
+		}
+		res.closed, err = readLegacyRows("job", dec, reader, func(values []interface{}) error {
+			res.rows = append(res.rows, values)
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		res.trailer = reader.Trailer
+		results <- res
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(conn, gob.NewEncoder(baselineWriter{conn}))
+
+	select {
+	case res := <-results:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not read")
+		return legacyResult{}
+	}
+}
+
+func sendRows(t *testing.T, enc *gob.Encoder) {
+	if err := enc.Encode([]string{"id", "name"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		if err := enc.Encode([]interface{}{int64(i), "row"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLegacyStreamBaselineAgent(t *testing.T) {
+	// Baseline agents close the connection without a close message
+	res := replayLegacy(t, func(conn *websocket.Conn, enc *gob.Encoder) {
+		sendRows(t, enc)
+		conn.Close()
+	})
+	if !res.closed || len(res.rows) != 3 || res.trailer != nil {
+		t.Errorf("got closed %v, %d rows, trailer %v; want a closed stream of 3 rows", res.closed, len(res.rows), res.trailer)
+	}
+	if len(res.columns) != 2 || res.rows[2][0] != int64(2) {
+		t.Errorf("got columns %v, rows %v", res.columns, res.rows)
+	}
+}
+
+func TestLegacyStreamCloseMessage(t *testing.T) {
+	res := replayLegacy(t, func(conn *websocket.Conn, enc *gob.Encoder) {
+		sendRows(t, enc)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		conn.Close()
+	})
+	if !res.closed || len(res.rows) != 3 {
+		t.Errorf("got closed %v, %d rows; want a closed stream of 3 rows", res.closed, len(res.rows))
+	}
+}
+
+func TestLegacyStreamGarbled(t *testing.T) {
+	res := replayLegacy(t, func(conn *websocket.Conn, enc *gob.Encoder) {
+		sendRows(t, enc)
+		conn.WriteMessage(websocket.BinaryMessage, []byte{0x7f, 0x01})
+		conn.Close()
+	})
+	if res.closed {
+		t.Errorf("a garbled row was reported as a closed stream")
+	}
+}
+
+func TestLegacyStreamTrailer(t *testing.T) {
+	res := replayLegacy(t, func(conn *websocket.Conn, enc *gob.Encoder) {
+		sendRows(t, enc)
+		trailer, _ := json.Marshal(protocol.StreamTrailer{Status: protocol.TrailerOK, Rows: 3})
+		conn.WriteMessage(websocket.TextMessage, trailer)
+		conn.Close()
+	})
+	if res.trailer == nil || res.trailer.Rows != 3 || len(res.rows) != 3 {
+		t.Errorf("got trailer %v, %d rows; want the trailer after 3 rows", res.trailer, len(res.rows))
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+
+	"mysql-exporter/internal/protocol"
+	"mysql-exporter/internal/reactor/hub"
+	"mysql-exporter/internal/reactor/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// dataWindow is the number of row batches an agent may have in flight before it
+// waits for an Ack. With the agent's batch size limit it bounds how much of a
+// stream is buffered between the query and the storage upload.
+const dataWindow = 8
+
+// readFramedStream ingests a version 2+ stream: a Hello/HelloAck handshake,
+// then schema, row batch and progress frames until an end or error frame.
+// A Hello with Resume set continues the session of an earlier connection.
+func (h *Handler) readFramedStream(conn *websocket.Conn, job *store.Job) {
+	jobID := job.ID
+	conn.SetReadLimit(protocol.MaxPayloadSize)
+
+	// 1. Handshake
+	frame, bytes, err := readFrame(conn)
+	var hello protocol.Hello
+	if err == nil {
+		if frame.Type != protocol.FrameHello {
+			err = fmt.Errorf("expected hello, got %s", frame.Type)
+		} else if err = frame.Decode(&hello); err == nil && hello.JobID != jobID {
+			err = fmt.Errorf("hello is for job %q", hello.JobID)
+		}
+	}
+	if err != nil {
+		slog.Error("Data Stream handshake failed", "job_id", jobID, "error", err)
+		if _, ok := h.sessions.Load(jobID); ok {
+			return // an interrupted stream stays open for the agent to try again
+		}
+		h.failJob(jobID, 0, bytes, fmt.Sprintf("handshake failed: %v", err))
+		return
+	}
+
+	var sess *streamSession
+	if hello.Resume {
+		if sess = h.resumeSession(jobID); sess == nil {
+			h.rejectResume(conn, job, hello.Spool)
+			return
+		}
+	} else {
+		if hello.Spooled {
+			slog.Info("Receiving spooled Data Stream", "job_id", jobID, "status", job.Status)
+		}
+		sess = h.newSession(job)
+	}
+	defer sess.mu.Unlock()
+	sess.bytes += bytes
+	sess.spool = hello.Spool
+
+	compression := protocol.NegotiateCompression(hello.Compression)
+	err = writeFrame(conn, protocol.FrameHelloAck, protocol.HelloAck{
+		Version:     protocol.ProtocolVersion,
+		Compression: compression,
+		Window:      dataWindow,
+		Resumed:     hello.Resume,
+		Seq:         sess.seq,
+		Spool:       hello.Spool,
+		EndAck:      true,
+	})
+	if err == nil {
+		slog.Info("Data Stream Handshake", "job_id", jobID, "agent_version", hello.AgentVersion,
+			"compression", compression, "resumed", hello.Resume, "seq", sess.seq)
+
+		// 2. Read frames until the agent ends the stream
+		err = h.readFrames(conn, sess)
+	}
+	if err != nil && h.parkSession(sess, err) {
+		return
+	}
+	h.endSession(sess)
+}
+
+// readFrames reads frames into the session until the stream ends and records
+// the outcome. It returns an error only if the connection was lost first.
+func (h *Handler) readFrames(conn *websocket.Conn, sess *streamSession) error {
+	jobID := sess.job.ID
+	for {
+		frame, n, err := readFrame(conn)
+		sess.bytes += n
+		if err != nil {
+			return err
+		}
+
+		switch frame.Type {
+		case protocol.FrameSchema:
+			var schema protocol.Schema
+			if err := frame.Decode(&schema); err != nil {
+				h.failJob(jobID, sess.rows, sess.bytes, err.Error())
+				return nil
+			}
+			sess.checksum.Write(frame.Payload)
+			slog.Info("Received Schema", "columns", schema.Columns, "typed", len(schema.Types) > 0)
+
+			if sess.art != nil {
+				h.failJob(jobID, sess.rows, sess.bytes, "duplicate schema frame")
+				return nil
+			}
+			if sess.art = h.startExport(sess.job, sess.bytes); sess.art == nil {
+				return nil
+			}
+			if err := sess.art.WriteSchema(schema); err != nil {
+				h.failJob(jobID, sess.rows, sess.bytes, fmt.Sprintf("failed to write header: %v", err))
+				return nil
+			}
+
+		case protocol.FrameRowBatch:
+			if sess.art == nil {
+				h.failJob(jobID, sess.rows, sess.bytes, "row batch before schema")
+				return nil
+			}
+			var batch protocol.RowBatch
+			if err := frame.Decode(&batch); err != nil {
+				h.truncateJob(jobID, sess.rows, sess.bytes, err.Error())
+				return nil
+			}
+
+			seq := batch.Seq
+			if seq == 0 {
+				seq = sess.seq + 1 // agents that predate resuming do not number batches
+			}
+			if seq <= sess.seq {
+				// Resent after a resume but already stored
+				if err := writeFrame(conn, protocol.FrameAck, protocol.Ack{Batches: 1, Seq: sess.seq}); err != nil {
+					slog.Warn("Failed to acknowledge row batch", "job_id", jobID, "error", err)
+				}
+				continue
+			}
+			if seq > sess.seq+1 {
+				h.truncateJob(jobID, sess.rows, sess.bytes, fmt.Sprintf("row batch %d is missing", sess.seq+1))
+				return nil
+			}
+
+			sess.checksum.Write(frame.Payload)
+			for _, values := range batch.Rows {
+				if err := sess.art.WriteRow(values); err != nil {
+					h.failJob(jobID, sess.rows, sess.bytes, fmt.Sprintf("failed to write row: %v", err))
+					return nil
+				}
+				sess.rows++
+			}
+			sess.seq = seq
+
+			// The rows were handed to the upload, which blocks while storage is slow
+			if err := writeFrame(conn, protocol.FrameAck, protocol.Ack{Batches: 1, Seq: seq}); err != nil {
+				slog.Warn("Failed to acknowledge row batch", "job_id", jobID, "error", err)
+			}
+
+		case protocol.FrameProgress:
+			var progress protocol.Progress
+			if err := frame.Decode(&progress); err != nil {
+				slog.Warn("Invalid progress frame", "job_id", jobID, "error", err)
+				continue
+			}
+			h.Hub.Broadcast(hub.DashboardUpdate{
+				Type:  "progress",
+				JobID: jobID,
+				Rows:  int(progress.Rows),
+			})
+
+		case protocol.FrameError:
+			var streamErr protocol.StreamError
+			if err := frame.Decode(&streamErr); err != nil {
+				h.failJob(jobID, sess.rows, sess.bytes, err.Error())
+				ackEnd(conn, sess)
+				return nil
+			}
+			if streamErr.Class == protocol.ErrorClassCancelled {
+				h.cancelStream(jobID, sess.rows)
+			} else {
+				h.failJob(jobID, sess.rows, sess.bytes, fmt.Sprintf("%s error: %s", streamErr.Class, streamErr.Message))
+			}
+			ackEnd(conn, sess)
+			return nil
+
+		case protocol.FrameEnd:
+			var end protocol.End
+			if err := frame.Decode(&end); err != nil {
+				h.truncateJob(jobID, sess.rows, sess.bytes, err.Error())
+				ackEnd(conn, sess)
+				return nil
+			}
+			switch {
+			case sess.art == nil:
+				h.failJob(jobID, sess.rows, sess.bytes, "end frame before schema")
+			case end.Rows != sess.rows:
+				h.truncateJob(jobID, sess.rows, sess.bytes, fmt.Sprintf("row count mismatch: agent sent %d, received %d", end.Rows, sess.rows))
+			case end.Checksum != hex.EncodeToString(sess.checksum.Sum(nil)):
+				h.truncateJob(jobID, sess.rows, sess.bytes, "checksum mismatch")
+			default:
+				h.completeJob(jobID, sess.rows, sess.bytes, sess.art)
+			}
+			ackEnd(conn, sess)
+			return nil
+
+		default:
+			// Newer agents may send frames this Reactor does not know yet
+			slog.Warn("Ignoring unknown frame", "job_id", jobID, "type", frame.Type)
+		}
+	}
+}
+
+// ackEnd tells the agent that the outcome of its stream is recorded, so it can
+// let go of its copy of the stream.
+func ackEnd(conn *websocket.Conn, sess *streamSession) {
+	if err := writeFrame(conn, protocol.FrameAck, protocol.Ack{Seq: sess.seq, End: true}); err != nil {
+		slog.Warn("Failed to acknowledge end of Data Stream", "job_id", sess.job.ID, "error", err)
+	}
+}
+
+func writeFrame(conn *websocket.Conn, t protocol.FrameType, v interface{}) error {
+	data, err := protocol.EncodeFrame(t, v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// readFrame reads one frame and reports the size of the message it came in.
+func readFrame(conn *websocket.Conn) (protocol.Frame, int64, error) {
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		return protocol.Frame{}, 0, err
+	}
+	if messageType != websocket.BinaryMessage {
+		return protocol.Frame{}, int64(len(data)), fmt.Errorf("unexpected message type %d", messageType)
+	}
+	frame, err := protocol.DecodeFrame(data)
+	return frame, int64(len(data)), err
+}
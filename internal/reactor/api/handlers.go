@@ -1,16 +1,19 @@
 package api
 
 import (
-	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
+	"mysql-exporter/internal/protocol"
 	"mysql-exporter/internal/reactor/hub"
 	"mysql-exporter/internal/reactor/store"
+	"mysql-exporter/internal/storage"
+	"mysql-exporter/internal/tunnel"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
@@ -28,13 +31,38 @@ type Handler struct {
 	Store     *store.Store
 	Hub       *hub.Hub
 	APISecret string
+
+	// Storage receives the files exported from agent data streams,
+	// gzipped if UseGzip is set.
+	Storage storage.Provider
+	UseGzip bool
+
+	// Tunnels carries agent connections over HTTP long-polling, for agents
+	// whose network blocks WebSocket upgrades. nil disables it.
+	Tunnels *tunnel.Server
+
+	// RequireAgentCert rejects agents that connect without a verified client
+	// certificate. A certificate is checked against the agent key either way.
+	RequireAgentCert bool
+
+	// AgentVersion is the latest agent release, advertised to agents that
+	// announce a different version. Empty advertises nothing.
+	AgentVersion string
+
+	// streams holds the open data connection for each running job, keyed by job ID.
+	streams sync.Map
+	// sessions holds the *streamSession of each framed data stream, keyed by
+	// job ID, until its outcome is recorded.
+	sessions sync.Map
 }
 
-func NewHandler(s *store.Store, h *hub.Hub, secret string) *Handler {
+func NewHandler(s *store.Store, h *hub.Hub, secret string, sp storage.Provider, useGzip bool) *Handler {
 	return &Handler{
 		Store:     s,
 		Hub:       h,
 		APISecret: secret,
+		Storage:   sp,
+		UseGzip:   useGzip,
 	}
 }
 
@@ -220,28 +248,87 @@ func (h *Handler) HandleDashboard(w http.ResponseWriter, r *http.Request) {
 
 // --- Agent Handlers ---
 
-type JobCommand struct {
-	ID    string `json:"id"`
-	Query string `json:"query"`
-}
-
-func (h *Handler) HandleControl(w http.ResponseWriter, r *http.Request) {
+// authenticateAgent verifies the X-Agent-Key header of an agent request.
+// On failure it responds with 401 and returns nil.
+func (h *Handler) authenticateAgent(w http.ResponseWriter, r *http.Request) *store.APIKey {
 	agentKeyRaw := r.Header.Get("X-Agent-Key")
 	if agentKeyRaw == "" {
 		http.Error(w, "Missing Agent Key", http.StatusUnauthorized)
-		return
+		return nil
 	}
 
 	apiKey, err := h.Store.VerifyAPIKey(agentKeyRaw)
 	if err != nil {
 		slog.Warn("Invalid Agent Key", "key", agentKeyRaw, "error", err)
 		http.Error(w, "Invalid Agent Key", http.StatusUnauthorized)
+		return nil
+	}
+	if err := h.checkAgentCert(r, apiKey); err != nil {
+		slog.Warn("Agent client certificate rejected", "key_id", apiKey.ID, "error", err)
+		http.Error(w, "Invalid client certificate", http.StatusForbidden)
+		return nil
+	}
+	return apiKey
+}
+
+// checkAgentCert binds the client certificate of an agent connection, verified
+// during the TLS handshake, to its key: it must be issued for that key, so a
+// leaked key alone does not let anyone connect as the agent.
+func (h *Handler) checkAgentCert(r *http.Request, apiKey *store.APIKey) error {
+	state := r.TLS
+	if state == nil {
+		// Made through a tunnel, whose opening request carried the certificate
+		state = tunnel.TLSState(r.Context())
+	}
+	if state == nil || len(state.VerifiedChains) == 0 {
+		if h.RequireAgentCert {
+			return errors.New("client certificate required")
+		}
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	if want := protocol.AgentCertName(apiKey.ID); cert.Subject.CommonName != want {
+		return fmt.Errorf("certificate %q is not issued for this key (want %q)", cert.Subject.CommonName, want)
+	}
+	return nil
+}
+
+// HandleTunnelOpen opens a tunnel for an authenticated agent. The agent then
+// connects to /agent/control or /agent/data through it as usual.
+func (h *Handler) HandleTunnelOpen(w http.ResponseWriter, r *http.Request) {
+	if h.Tunnels == nil {
+		http.NotFound(w, r)
 		return
 	}
+	apiKey := h.authenticateAgent(w, r)
+	if apiKey == nil {
+		return
+	}
+	h.Tunnels.Open(w, r, apiKey.ID)
+}
 
-	slog.Info("Agent Connected (Control)", "key_id", apiKey.ID, "type", apiKey.Type)
-	h.Hub.UpdateAgentCount(1)
-	defer h.Hub.UpdateAgentCount(-1)
+// HandleTunnel carries the bytes of an open tunnel, named by its ID.
+func (h *Handler) HandleTunnel(w http.ResponseWriter, r *http.Request) {
+	if h.Tunnels == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.Tunnels.ServeHTTP(w, r)
+}
+
+// HandleAgentCheck lets `fluxquery-agent check` test its key, certificate and
+// connection without registering, so a running agent with the same key stays
+// connected. The agent connects with a WebSocket upgrade, which is closed right
+// away, to also test that upgrades get through.
+func (h *Handler) HandleAgentCheck(w http.ResponseWriter, r *http.Request) {
+	apiKey := h.authenticateAgent(w, r)
+	if apiKey == nil {
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -249,54 +336,16 @@ func (h *Handler) HandleControl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(10*time.Second))
+}
 
-	// Detect Sandbox Mode
-	isSandbox := (apiKey.Type == "test")
-
-	// Simulate "Dispatch Job"
-	go func() {
-		delay := 5 * time.Second
-		if isSandbox {
-			delay = 2 * time.Second // Faster in sandbox
-		}
-		time.Sleep(delay)
-
-		jobID := "job_" + apiKey.Type + "_" + time.Now().Format("150405")
-		query := "SELECT * FROM users LIMIT 100"
-		if isSandbox {
-			query = "SELECT * FROM users_test_data LIMIT 10" // Sandbox specific query
-		}
-
-		job := JobCommand{
-			ID:    jobID,
-			Query: query,
-		}
-
-		payload, _ := json.Marshal(job)
-		if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
-			slog.Error("Failed to send job", "error", err)
-			return
-		}
-		slog.Info("Dispatched Job", "id", job.ID, "sandbox", isSandbox)
-
-		h.Hub.Broadcast(hub.DashboardUpdate{
-			Type:   "job_start",
-			JobID:  job.ID,
-			Status: "dispatched",
-		})
-	}()
-
-	for {
-		if _, _, err := conn.NextReader(); err != nil {
-			slog.Info("Agent Disconnected (Control)")
-			break
-		}
+func (h *Handler) HandleControl(w http.ResponseWriter, r *http.Request) {
+	apiKey := h.authenticateAgent(w, r)
+	if apiKey == nil {
+		return
 	}
-}
 
-func (h *Handler) HandleData(w http.ResponseWriter, r *http.Request) {
-	jobID := r.URL.Query().Get("job_id")
-	slog.Info("Agent Connected (Data Stream)", "job_id", jobID)
+	slog.Info("Agent Connected (Control)", "key_id", apiKey.ID, "type", apiKey.Type)
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -305,68 +354,105 @@ func (h *Handler) HandleData(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	dec := gob.NewDecoder(&WSReader{Conn: conn})
+	agent := h.Hub.RegisterAgent(apiKey.ID, apiKey.UserID, conn)
+	defer h.Hub.UnregisterAgent(agent)
 
-	// 1. Read Columns
-	var columns []string
-	if err := dec.Decode(&columns); err != nil {
-		slog.Error("Failed to decode columns", "error", err)
-		return
-	}
-	slog.Info("Received Schema", "columns", columns)
+	// Liveness: any frame from the agent (message or pong) extends the read deadline.
+	conn.SetReadDeadline(time.Now().Add(protocol.PongWait))
+	conn.SetPongHandler(func(string) error {
+		agent.Touch()
+		return conn.SetReadDeadline(time.Now().Add(protocol.PongWait))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go pingLoop(conn, done)
 
-	// 2. Read Rows
-	rowCount := 0
 	for {
-		var values []interface{}
-		if err := dec.Decode(&values); err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				break
-			}
-			slog.Info("Stream ended", "reason", err)
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			slog.Info("Agent Disconnected (Control)", "key_id", apiKey.ID)
 			break
 		}
-		rowCount++
-
-		if rowCount%10 == 0 {
-			h.Hub.Broadcast(hub.DashboardUpdate{
-				Type:  "progress",
-				JobID: jobID,
-				Rows:  rowCount,
-			})
+
+		conn.SetReadDeadline(time.Now().Add(protocol.PongWait))
+
+		var msg protocol.ControlMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			slog.Warn("Invalid agent message", "key_id", apiKey.ID, "error", err)
+			continue
 		}
+		h.handleAgentMessage(agent, msg)
 	}
-
-	slog.Info("Data Stream Complete", "job_id", jobID, "total_rows", rowCount)
-	h.Hub.Broadcast(hub.DashboardUpdate{
-		Type:  "job_complete",
-		JobID: jobID,
-		Rows:  rowCount,
-	})
 }
 
-// WSReader Helper (could be moved to util if shared)
-type WSReader struct {
-	Conn   *websocket.Conn
-	reader io.Reader
+func (h *Handler) handleAgentMessage(agent *hub.AgentConn, msg protocol.ControlMessage) {
+	agent.Touch()
+
+	switch msg.Type {
+	case protocol.TypeHello:
+		agent.Announce(msg.Driver, msg.Version, msg.Hostname, msg.Sources)
+		slog.Info("Agent Announced", "key_id", agent.KeyID, "driver", msg.Driver, "version", msg.Version, "hostname", msg.Hostname, "sources", len(msg.Sources))
+		if h.AgentVersion != "" && msg.Version != h.AgentVersion {
+			// The agent decides whether to take it, e.g. development builds never do
+			if err := agent.Send(protocol.ControlMessage{Type: protocol.TypeUpdate, Version: h.AgentVersion}); err != nil {
+				slog.Warn("Failed to advertise agent update", "key_id", agent.KeyID, "error", err)
+			}
+		}
+	case protocol.TypeHeartbeat:
+		agent.Heartbeat(msg.Load)
+	case protocol.TypeJobStatus:
+		if msg.Load != nil {
+			agent.Heartbeat(msg.Load)
+		}
+		h.handleJobStatus(agent, msg)
+	case protocol.TypeDraining:
+		// The load is flagged as draining, which keeps new jobs away
+		if msg.Load != nil {
+			agent.Heartbeat(msg.Load)
+		}
+		slog.Info("Agent Draining", "key_id", agent.KeyID)
+	default:
+		slog.Warn("Unknown agent message", "key_id", agent.KeyID, "type", msg.Type)
+	}
 }
 
-func (r *WSReader) Read(p []byte) (n int, err error) {
-	if r.reader == nil {
-		_, reader, err := r.Conn.NextReader() // messageType ignored
-		if err != nil {
-			return 0, err
+func (h *Handler) handleJobStatus(agent *hub.AgentConn, msg protocol.ControlMessage) {
+	job, err := h.Store.GetJob(msg.JobID)
+	if err != nil || job.AgentKeyID != agent.KeyID {
+		slog.Warn("Job status for unknown job", "key_id", agent.KeyID, "job_id", msg.JobID)
+		return
+	}
+
+	switch msg.Status {
+	case protocol.JobQueued:
+		if err := h.Store.MarkJobQueued(job.ID); err != nil {
+			logTransitionError("Failed to mark job queued", job.ID, err)
+			return
 		}
-		r.reader = reader
+		h.Hub.Broadcast(hub.DashboardUpdate{Type: "job_status", JobID: job.ID, Status: "queued"})
+	case protocol.JobStarted:
+		h.Hub.Broadcast(hub.DashboardUpdate{Type: "job_status", JobID: job.ID, Status: "started"})
+	case protocol.JobRejected:
+		slog.Warn("Agent rejected job", "key_id", agent.KeyID, "job_id", job.ID, "reason", msg.Reason)
+		h.failJob(job.ID, 0, 0, "rejected by agent: "+msg.Reason)
 	}
+}
+
+// pingLoop pings the agent until done is closed or a ping fails.
+// WriteControl is safe to call concurrently with the connection's other writers.
+func pingLoop(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(protocol.PingInterval)
+	defer ticker.Stop()
 
-	n, err = r.reader.Read(p)
-	if err == io.EOF {
-		r.reader = nil
-		return r.Read(p) // Try next message
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
 	}
-	return n, err
 }
@@ -0,0 +1,343 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+	"mysql-exporter/internal/reactor/hub"
+	middleware "mysql-exporter/internal/reactor/middleware"
+	"mysql-exporter/internal/reactor/store"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// --- Job Handlers ---
+
+var supportedFormats = map[string]bool{
+	"csv":   true,
+	"json":  true,
+	"excel": true,
+	"pdf":   true,
+}
+
+type CreateJobRequest struct {
+	AgentID int    `json:"agent_id"` // API key ID the agent connects with
+	Source  string `json:"source"`   // agent data source, empty for the agent's default
+	Query   string `json:"query"`
+	Format  string `json:"format"` // "csv" (default), "json", "excel" or "pdf"
+}
+
+// HandleCreateJob persists a job for the authenticated user and dispatches it
+// to the target agent's control socket.
+func (h *Handler) HandleCreateJob(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid user", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	req.Query = strings.TrimSpace(req.Query)
+	if req.Query == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+	if req.Format == "" {
+		req.Format = "csv"
+	}
+	if !supportedFormats[req.Format] {
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	// Users may only target agents running with their own keys
+	key, err := h.Store.GetAPIKey(req.AgentID)
+	if err != nil || key.UserID != userID {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+
+	agent, ok := h.Hub.Agent(req.AgentID)
+	if !ok {
+		http.Error(w, "Agent is not connected", http.StatusConflict)
+		return
+	}
+	if !hasSource(agent.Info(), req.Source) {
+		http.Error(w, "Unknown source", http.StatusBadRequest)
+		return
+	}
+	if load := agent.Info().Load; load != nil && load.Draining {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Agent is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if agent.Info().Load.Saturated() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Agent is busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	job := &store.Job{
+		ID:         uuid.New().String(),
+		UserID:     userID,
+		AgentKeyID: req.AgentID,
+		Source:     req.Source,
+		Query:      req.Query,
+		Format:     req.Format,
+		Status:     store.JobPending,
+	}
+	if err := h.Store.CreateJob(job); err != nil {
+		slog.Error("Create job failed", "error", err)
+		http.Error(w, "Failed to create job", http.StatusInternalServerError)
+		return
+	}
+
+	// Mark the job dispatched before sending, otherwise a fast agent could open
+	// the data stream before the status change lands.
+	if err := h.Store.MarkJobDispatched(job.ID); err != nil {
+		slog.Error("Failed to mark job dispatched", "id", job.ID, "error", err)
+		http.Error(w, "Failed to dispatch job", http.StatusInternalServerError)
+		return
+	}
+	job.Status = store.JobDispatched
+
+	if err := agent.Send(protocol.ControlMessage{Type: protocol.TypeJob, JobID: job.ID, Source: job.Source, Query: job.Query}); err != nil {
+		slog.Error("Failed to send job", "id", job.ID, "key_id", req.AgentID, "error", err)
+		if err := h.Store.FailJob(job.ID, 0, 0, "dispatch failed: "+err.Error()); err != nil {
+			slog.Error("Failed to mark job failed", "id", job.ID, "error", err)
+		}
+		http.Error(w, "Failed to dispatch job", http.StatusBadGateway)
+		return
+	}
+	slog.Info("Dispatched Job", "id", job.ID, "key_id", req.AgentID)
+
+	h.Hub.Broadcast(hub.DashboardUpdate{
+		Type:   "job_start",
+		JobID:  job.ID,
+		Status: "dispatched",
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(job)
+}
+
+// hasSource reports whether the agent serves the named source. Every agent
+// has a default source; agents that predate named sources have only that one.
+func hasSource(info hub.AgentInfo, name string) bool {
+	if name == "" {
+		return true
+	}
+	for _, s := range info.Sources {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// userIDFromRequest reads the user ID placed in the context by middleware.Auth.
+func userIDFromRequest(r *http.Request) (int, error) {
+	raw, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		return 0, fmt.Errorf("missing user id")
+	}
+
+	var userID int
+	if _, err := fmt.Sscan(raw, &userID); err != nil {
+		return 0, fmt.Errorf("invalid user id %q: %w", raw, err)
+	}
+	return userID, nil
+}
+
+// HandleGetJob returns a single job owned by the authenticated user.
+func (h *Handler) HandleGetJob(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid user", http.StatusUnauthorized)
+		return
+	}
+
+	job, err := h.Store.GetJob(r.PathValue("id"))
+	if err != nil {
+		if errors.Is(err, store.ErrJobNotFound) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		slog.Error("Get job failed", "error", err)
+		http.Error(w, "Failed to get job", http.StatusInternalServerError)
+		return
+	}
+
+	// Report other users' jobs as missing rather than forbidden to avoid leaking IDs
+	if job.UserID != userID {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	h.setDownloadURL(job)
+	json.NewEncoder(w).Encode(job)
+}
+
+// setDownloadURL links a completed job to its exported file.
+func (h *Handler) setDownloadURL(job *store.Job) {
+	if job.ArtifactKey != "" {
+		job.DownloadURL = h.Storage.GetDownloadURL(job.ArtifactKey)
+	}
+}
+
+// cancelGracePeriod is how long the agent gets to close the data stream itself
+// before the Reactor drops the connection.
+const cancelGracePeriod = 10 * time.Second
+
+// HandleCancelJob stops a job owned by the authenticated user. The job is marked
+// CANCELLED immediately; the agent is told to abort the query and close its stream.
+func (h *Handler) HandleCancelJob(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid user", http.StatusUnauthorized)
+		return
+	}
+
+	job, err := h.Store.GetJob(r.PathValue("id"))
+	if err != nil || job.UserID != userID {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.Store.CancelJob(job.ID); err != nil {
+		if errors.Is(err, store.ErrInvalidTransition) {
+			http.Error(w, "Job already finished", http.StatusConflict)
+			return
+		}
+		slog.Error("Cancel job failed", "id", job.ID, "error", err)
+		http.Error(w, "Failed to cancel job", http.StatusInternalServerError)
+		return
+	}
+
+	if agent, ok := h.Hub.Agent(job.AgentKeyID); ok {
+		if err := agent.Send(protocol.ControlMessage{Type: protocol.TypeCancel, JobID: job.ID}); err != nil {
+			slog.Warn("Failed to send cancel to agent", "id", job.ID, "key_id", job.AgentKeyID, "error", err)
+		}
+	}
+
+	if conn, ok := h.streams.Load(job.ID); ok {
+		time.AfterFunc(cancelGracePeriod, func() {
+			conn.(*websocket.Conn).Close()
+		})
+	}
+
+	slog.Info("Cancelled Job", "id", job.ID)
+	h.Hub.Broadcast(hub.DashboardUpdate{
+		Type:   "job_cancelled",
+		JobID:  job.ID,
+		Status: "cancelled",
+	})
+
+	if updated, err := h.Store.GetJob(job.ID); err == nil {
+		job = updated
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+const (
+	defaultJobPageSize = 50
+	maxJobPageSize     = 200
+)
+
+type ListJobsResponse struct {
+	Jobs   []store.Job `json:"jobs"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+// HandleListJobs returns the authenticated user's job history.
+// Supported query parameters: status, agent_id, from, to (RFC 3339 or YYYY-MM-DD), limit, offset.
+func (h *Handler) HandleListJobs(w http.ResponseWriter, r *http.Request) {
+	userID, err := userIDFromRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid user", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := store.JobFilter{
+		UserID: userID,
+		Status: store.JobStatus(strings.ToUpper(q.Get("status"))),
+		Limit:  defaultJobPageSize,
+	}
+
+	if v := q.Get("agent_id"); v != "" {
+		if _, err := fmt.Sscan(v, &filter.AgentKeyID); err != nil {
+			http.Error(w, "Invalid agent_id", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("from"); v != "" {
+		if filter.From, err = parseDateParam(v); err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if filter.To, err = parseDateParam(v); err != nil {
+			http.Error(w, "Invalid to date", http.StatusBadRequest)
+			return
+		}
+		// A bare date means "up to the end of that day"
+		if len(v) == len(time.DateOnly) {
+			filter.To = filter.To.AddDate(0, 0, 1)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if _, err := fmt.Sscan(v, &filter.Limit); err != nil || filter.Limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if filter.Limit > maxJobPageSize {
+			filter.Limit = maxJobPageSize
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if _, err := fmt.Sscan(v, &filter.Offset); err != nil || filter.Offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	jobs, total, err := h.Store.ListJobs(filter)
+	if err != nil {
+		slog.Error("List jobs failed", "error", err)
+		http.Error(w, "Failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+	for i := range jobs {
+		h.setDownloadURL(&jobs[i])
+	}
+
+	json.NewEncoder(w).Encode(ListJobsResponse{
+		Jobs:   jobs,
+		Total:  total,
+		Limit:  filter.Limit,
+		Offset: filter.Offset,
+	})
+}
+
+func parseDateParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
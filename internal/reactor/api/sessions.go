@@ -0,0 +1,148 @@
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"log/slog"
+	"sync"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+	"mysql-exporter/internal/reactor/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// resumeGracePeriod is how long an interrupted data stream is kept open for
+// the agent to reconnect before the job is recorded as truncated.
+const resumeGracePeriod = 2 * time.Minute
+
+// streamSession is the state of a framed data stream. It outlives the
+// connection it started on, so an agent can resume the stream on a new one.
+type streamSession struct {
+	// mu is held by the connection currently reading the stream.
+	mu sync.Mutex
+
+	job      *store.Job
+	art      *artifact // nil until the schema arrived
+	rows     int64
+	bytes    int64
+	checksum hash.Hash
+	seq      uint64      // last row batch stored
+	spool    bool        // the agent uploads the stream later if it cannot resume it
+	grace    *time.Timer // runs while waiting for the agent to reconnect
+	done     bool
+}
+
+// newSession starts the session of a new stream and returns it locked. A
+// session left over from an earlier stream of the job is ended first.
+func (h *Handler) newSession(job *store.Job) *streamSession {
+	sess := &streamSession{job: job, checksum: sha256.New()}
+	sess.mu.Lock()
+
+	if v, loaded := h.sessions.Swap(job.ID, sess); loaded {
+		// The agent started over, e.g. after it was restarted
+		old := v.(*streamSession)
+		old.mu.Lock()
+		if !old.done {
+			slog.Info("Discarding interrupted Data Stream", "job_id", job.ID, "rows", old.rows)
+			h.endSession(old)
+		}
+		old.mu.Unlock()
+	}
+	return sess
+}
+
+// resumeSession returns the interrupted session of a job locked, or nil if
+// there is none to resume.
+func (h *Handler) resumeSession(jobID string) *streamSession {
+	v, ok := h.sessions.Load(jobID)
+	if !ok {
+		return nil
+	}
+
+	sess := v.(*streamSession)
+	sess.mu.Lock()
+	if sess.done {
+		sess.mu.Unlock()
+		return nil
+	}
+	if sess.grace != nil {
+		sess.grace.Stop()
+		sess.grace = nil
+	}
+	return sess
+}
+
+// rejectResume tells the agent its stream is gone, e.g. because its grace
+// period ran out or the Reactor restarted in between. Agents that spool the
+// stream upload it later, so their job waits for that instead.
+func (h *Handler) rejectResume(conn *websocket.Conn, job *store.Job, spool bool) {
+	slog.Warn("Data Stream could not be resumed", "job_id", job.ID, "spool", spool)
+	err := writeFrame(conn, protocol.FrameHelloAck, protocol.HelloAck{
+		Version:     protocol.ProtocolVersion,
+		Compression: protocol.CompressionNone,
+		Spool:       spool,
+	})
+	if err != nil {
+		slog.Warn("Failed to reject resume", "job_id", job.ID, "error", err)
+	}
+	if spool {
+		h.spoolJob(job.ID, job.RowCount, job.Bytes)
+		return
+	}
+	h.truncateJob(job.ID, 0, 0, "data stream could not be resumed")
+}
+
+// parkSession keeps the session of a lost connection open for the agent to
+// resume. It reports false if the stream cannot be resumed, in which case the
+// outcome has been recorded.
+func (h *Handler) parkSession(sess *streamSession, cause error) bool {
+	jobID := sess.job.ID
+	slog.Info("Stream interrupted", "job_id", jobID, "reason", cause)
+	reason := fmt.Sprintf("data stream ended without an end frame: %v", cause)
+
+	if sess.art == nil {
+		if sess.spool {
+			h.spoolJob(jobID, sess.rows, sess.bytes)
+		} else {
+			h.failJob(jobID, sess.rows, sess.bytes, reason)
+		}
+		return false
+	}
+	if job, err := h.Store.GetJob(jobID); err == nil && job.Status.IsTerminal() {
+		return false // e.g. cancelled, nothing left to resume
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(resumeGracePeriod, func() {
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		if sess.done || sess.grace != t {
+			return
+		}
+		if sess.spool {
+			h.spoolJob(jobID, sess.rows, sess.bytes)
+		} else {
+			h.truncateJob(jobID, sess.rows, sess.bytes, reason)
+		}
+		h.endSession(sess)
+	})
+	sess.grace = t
+	return true
+}
+
+// endSession discards the session once its outcome has been recorded,
+// along with the export if it was not completed. sess.mu must be held.
+func (h *Handler) endSession(sess *streamSession) {
+	sess.done = true
+	if sess.grace != nil {
+		sess.grace.Stop()
+		sess.grace = nil
+	}
+	if sess.art != nil {
+		sess.art.Abort()
+	}
+	h.sessions.CompareAndDelete(sess.job.ID, sess)
+}
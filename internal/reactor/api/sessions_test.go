@@ -0,0 +1,353 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+	"mysql-exporter/internal/reactor/hub"
+	"mysql-exporter/internal/reactor/store"
+	"mysql-exporter/internal/storage"
+
+	"github.com/gorilla/websocket"
+)
+
+// framedServer serves the framed data stream of job with a Handler backed by
+// an in-memory jobs table and local storage in a temporary directory.
+type framedServer struct {
+	h     *Handler
+	jobs  *jobTable
+	dir   string
+	url   string
+	jobID string
+}
+
+func newFramedServer(t *testing.T, status store.JobStatus) *framedServer {
+	t.Helper()
+	job := store.Job{ID: "job-1", AgentKeyID: 1, Format: "csv", Status: status}
+	st, jobs := newJobStore(t, job)
+	s := &framedServer{
+		jobs:  jobs,
+		dir:   t.TempDir(),
+		jobID: job.ID,
+	}
+	s.h = NewHandler(st, hub.NewHub(), "secret", storage.NewLocalProvider(s.dir), false)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := dataUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		s.h.readFramedStream(conn, &job)
+	}))
+	t.Cleanup(srv.Close)
+	s.url = "ws" + strings.TrimPrefix(srv.URL, "http")
+	return s
+}
+
+// waitStatus waits for the job to reach status and returns it.
+func (s *framedServer) waitStatus(t *testing.T, status store.JobStatus) store.Job {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if job := s.jobs.get(s.jobID); job.Status == status {
+			return job
+		}
+	}
+	job := s.jobs.get(s.jobID)
+	t.Fatalf("job is %s (%s), want %s", job.Status, job.Error, status)
+	return job
+}
+
+// parked waits for the session of a lost connection to wait for the agent,
+// and returns it.
+func (s *framedServer) parked(t *testing.T) *streamSession {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		v, ok := s.h.sessions.Load(s.jobID)
+		if !ok {
+			continue
+		}
+		sess := v.(*streamSession)
+		if sess.mu.TryLock() {
+			waiting := sess.grace != nil
+			sess.mu.Unlock()
+			if waiting {
+				return sess
+			}
+		}
+	}
+	t.Fatal("session was not parked")
+	return nil
+}
+
+// testAgent is the agent end of a framed data stream. checksum covers the
+// schema and row batches as the agent sends them the first time.
+type testAgent struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	checksum hash.Hash
+}
+
+func dialFramed(t *testing.T, s *framedServer, hello protocol.Hello, checksum hash.Hash) (*testAgent, protocol.HelloAck) {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: protocol.Subprotocols}
+	conn, _, err := dialer.Dial(s.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	a := &testAgent{t: t, conn: conn, checksum: checksum}
+	hello.Version = protocol.ProtocolVersion
+	hello.JobID = s.jobID
+	a.send(protocol.FrameHello, hello)
+	var ack protocol.HelloAck
+	a.expect(protocol.FrameHelloAck, &ack)
+	return a, ack
+}
+
+func (a *testAgent) frame(t protocol.FrameType, v interface{}) []byte {
+	a.t.Helper()
+	frame, err := protocol.NewFrame(t, v)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	data, err := frame.Marshal(protocol.CompressionNone)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+func (a *testAgent) send(t protocol.FrameType, v interface{}) {
+	a.t.Helper()
+	if err := a.conn.WriteMessage(websocket.BinaryMessage, a.frame(t, v)); err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+// sendData sends a schema or row batch frame and adds it to the checksum.
+func (a *testAgent) sendData(t protocol.FrameType, v interface{}) {
+	a.t.Helper()
+	data := a.frame(t, v)
+	a.checksum.Write(data[2:])
+	if err := a.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+func (a *testAgent) expect(t protocol.FrameType, v interface{}) {
+	a.t.Helper()
+	a.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := a.conn.ReadMessage()
+	if err != nil {
+		a.t.Fatalf("waiting for %s: %v", t, err)
+	}
+	frame, err := protocol.DecodeFrame(data)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	if frame.Type != t {
+		a.t.Fatalf("got %s frame, want %s", frame.Type, t)
+	}
+	if err := frame.Decode(v); err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+// sendBatch sends a row batch and waits for the Reactor to store it.
+func (a *testAgent) sendBatch(batch protocol.RowBatch) {
+	a.t.Helper()
+	a.sendData(protocol.FrameRowBatch, batch)
+	var ack protocol.Ack
+	a.expect(protocol.FrameAck, &ack)
+	if ack.Seq != batch.Seq {
+		a.t.Fatalf("batch %d acknowledged as %d", batch.Seq, ack.Seq)
+	}
+}
+
+// end ends the stream and waits for the Reactor to record its outcome.
+func (a *testAgent) end(end protocol.End) {
+	a.t.Helper()
+	a.send(protocol.FrameEnd, end)
+	var ack protocol.Ack
+	a.expect(protocol.FrameAck, &ack)
+	if !ack.End {
+		a.t.Fatalf("end acknowledged as %+v", ack)
+	}
+}
+
+// drop loses the connection partway through sending a row batch.
+func (a *testAgent) drop(batch protocol.RowBatch) {
+	a.t.Helper()
+	data := a.frame(protocol.FrameRowBatch, batch)
+	w, err := a.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	// More than the write buffer, so the first fragments reach the Reactor
+	if _, err := w.Write(data[:len(data)/2]); err != nil {
+		a.t.Fatal(err)
+	}
+	a.conn.UnderlyingConn().Close()
+}
+
+// rows numbers rows first to last, each with a value large enough for a few
+// rows to span several WebSocket fragments.
+func rows(first, last int) [][]interface{} {
+	var rows [][]interface{}
+	for i := first; i <= last; i++ {
+		rows = append(rows, []interface{}{int64(i), strings.Repeat(fmt.Sprint(i%10), 8192)})
+	}
+	return rows
+}
+
+var testSchema = protocol.Schema{Columns: []string{"id", "value"}}
+
+func TestFramedStreamResume(t *testing.T) {
+	s := newFramedServer(t, store.JobDispatched)
+	checksum := sha256.New()
+
+	a, ack := dialFramed(t, s, protocol.Hello{}, checksum)
+	if ack.Resumed || ack.Window == 0 || !ack.EndAck {
+		t.Fatalf("hello ack %+v", ack)
+	}
+	a.sendData(protocol.FrameSchema, testSchema)
+	a.sendBatch(protocol.RowBatch{Seq: 1, Rows: rows(1, 2)})
+	a.sendBatch(protocol.RowBatch{Seq: 2, Rows: rows(3, 4)})
+	third := protocol.RowBatch{Seq: 3, Rows: rows(5, 6)}
+	a.drop(third)
+	s.parked(t)
+
+	a, ack = dialFramed(t, s, protocol.Hello{Resume: true}, checksum)
+	if !ack.Resumed || ack.Seq != 2 {
+		t.Fatalf("resume acknowledged as %+v, want resumed after batch 2", ack)
+	}
+	// A batch the agent resends although it was stored is acknowledged, not stored again
+	a.send(protocol.FrameRowBatch, protocol.RowBatch{Seq: 2, Rows: rows(3, 4)})
+	var dup protocol.Ack
+	a.expect(protocol.FrameAck, &dup)
+	if dup.Seq != 2 {
+		t.Fatalf("resent batch 2 acknowledged as %d", dup.Seq)
+	}
+	a.sendBatch(third)
+	a.sendBatch(protocol.RowBatch{Seq: 4, Rows: rows(7, 8)})
+	a.end(protocol.End{Rows: 8, Checksum: hex.EncodeToString(checksum.Sum(nil))})
+
+	job := s.waitStatus(t, store.JobCompleted)
+	if job.RowCount != 8 {
+		t.Errorf("job completed with %d rows, want 8", job.RowCount)
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, job.ArtifactKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		id, _, _ := strings.Cut(sc.Text(), ",")
+		ids = append(ids, id)
+	}
+	if got := strings.Join(ids, " "); got != "id 1 2 3 4 5 6 7 8" {
+		t.Errorf("export has rows %s, want each of 1 to 8 once", got)
+	}
+}
+
+func TestFramedStreamGraceExpired(t *testing.T) {
+	s := newFramedServer(t, store.JobDispatched)
+	checksum := sha256.New()
+
+	a, _ := dialFramed(t, s, protocol.Hello{}, checksum)
+	a.sendData(protocol.FrameSchema, testSchema)
+	a.sendBatch(protocol.RowBatch{Seq: 1, Rows: rows(1, 2)})
+	a.drop(protocol.RowBatch{Seq: 2, Rows: rows(3, 4)})
+
+	// Let the grace period run out now
+	sess := s.parked(t)
+	sess.mu.Lock()
+	sess.grace.Reset(0)
+	sess.mu.Unlock()
+	job := s.waitStatus(t, store.JobTruncated)
+	if job.RowCount != 2 {
+		t.Errorf("job truncated with %d rows, want 2", job.RowCount)
+	}
+
+	// The agent comes back too late
+	_, ack := dialFramed(t, s, protocol.Hello{Resume: true}, checksum)
+	if ack.Resumed {
+		t.Fatal("expired stream was resumed")
+	}
+	if job := s.jobs.get(s.jobID); job.Status != store.JobTruncated || job.RowCount != 2 {
+		t.Errorf("job is %s with %d rows after the late resume", job.Status, job.RowCount)
+	}
+}
+
+func TestFramedStreamRejectResume(t *testing.T) {
+	// E.g. the Reactor restarted while the agent was reconnecting
+	s := newFramedServer(t, store.JobRunning)
+
+	_, ack := dialFramed(t, s, protocol.Hello{Resume: true}, sha256.New())
+	if ack.Resumed {
+		t.Fatal("unknown stream was resumed")
+	}
+	s.waitStatus(t, store.JobTruncated)
+}
+
+func TestFramedStreamSpooled(t *testing.T) {
+	s := newFramedServer(t, store.JobDispatched)
+
+	a, ack := dialFramed(t, s, protocol.Hello{Spool: true}, sha256.New())
+	if !ack.Spool {
+		t.Fatalf("hello ack %+v does not confirm the spool", ack)
+	}
+	a.sendData(protocol.FrameSchema, testSchema)
+	a.sendBatch(protocol.RowBatch{Seq: 1, Rows: rows(1, 2)})
+	a.drop(protocol.RowBatch{Seq: 2, Rows: rows(3, 4)})
+
+	// The agent does not come back in time, so the job waits for its spool
+	sess := s.parked(t)
+	sess.mu.Lock()
+	sess.grace.Reset(0)
+	sess.mu.Unlock()
+	s.waitStatus(t, store.JobSpooled)
+
+	// The spooled upload starts over from the schema
+	checksum := sha256.New()
+	a, ack = dialFramed(t, s, protocol.Hello{Spool: true, Spooled: true}, checksum)
+	if ack.Resumed || ack.Seq != 0 {
+		t.Fatalf("spooled upload acknowledged as %+v", ack)
+	}
+	a.sendData(protocol.FrameSchema, testSchema)
+	a.sendBatch(protocol.RowBatch{Seq: 1, Rows: rows(1, 2)})
+	a.sendBatch(protocol.RowBatch{Seq: 2, Rows: rows(3, 4)})
+	a.end(protocol.End{Rows: 4, Checksum: hex.EncodeToString(checksum.Sum(nil))})
+
+	if job := s.waitStatus(t, store.JobCompleted); job.RowCount != 4 {
+		t.Errorf("job completed with %d rows, want 4", job.RowCount)
+	}
+}
+
+func TestFramedStreamRejectResumeSpool(t *testing.T) {
+	s := newFramedServer(t, store.JobRunning)
+
+	_, ack := dialFramed(t, s, protocol.Hello{Resume: true, Spool: true}, sha256.New())
+	if ack.Resumed || !ack.Spool {
+		t.Fatalf("resume rejected as %+v, want the spool confirmed", ack)
+	}
+	s.waitStatus(t, store.JobSpooled)
+}
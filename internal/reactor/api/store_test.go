@@ -0,0 +1,200 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"mysql-exporter/internal/reactor/store"
+)
+
+// jobTable is an in-memory jobs table behind a store.Store, for tests of the
+// handlers that record the outcome of jobs. It understands the queries
+// GetJob and the job transitions make, nothing else.
+type jobTable struct {
+	mu   sync.Mutex
+	jobs map[string]*store.Job
+}
+
+// jobTables holds the table of each test, keyed by DSN.
+var jobTables sync.Map
+
+func init() {
+	sql.Register("jobtable", jobsDriver{})
+}
+
+// newJobStore returns a store whose jobs table holds jobs.
+func newJobStore(t *testing.T, jobs ...store.Job) (*store.Store, *jobTable) {
+	t.Helper()
+	table := &jobTable{jobs: make(map[string]*store.Job)}
+	for _, job := range jobs {
+		table.jobs[job.ID] = &job
+	}
+	jobTables.Store(t.Name(), table)
+	t.Cleanup(func() { jobTables.Delete(t.Name()) })
+
+	db, err := sql.Open("jobtable", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return store.New(db), table
+}
+
+// get returns a copy of a job as stored.
+func (tb *jobTable) get(id string) store.Job {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if job, ok := tb.jobs[id]; ok {
+		return *job
+	}
+	return store.Job{}
+}
+
+type jobsDriver struct{}
+
+func (jobsDriver) Open(dsn string) (driver.Conn, error) {
+	table, ok := jobTables.Load(dsn)
+	if !ok {
+		return nil, fmt.Errorf("no job table %q", dsn)
+	}
+	return &jobsConn{table: table.(*jobTable)}, nil
+}
+
+type jobsConn struct {
+	table *jobTable
+}
+
+func (c *jobsConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("jobtable: prepared statements are not supported")
+}
+
+func (c *jobsConn) Close() error { return nil }
+
+func (c *jobsConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("jobtable: transactions are not supported")
+}
+
+// QueryContext answers GetJob: SELECT <columns> FROM jobs WHERE id = ?.
+func (c *jobsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	columns, ok := strings.CutPrefix(query, "SELECT ")
+	if !ok || !strings.HasSuffix(columns, " FROM jobs WHERE id = ?") || len(args) != 1 {
+		return nil, fmt.Errorf("jobtable: unsupported query %q", query)
+	}
+	names := strings.Split(strings.TrimSuffix(columns, " FROM jobs WHERE id = ?"), ", ")
+
+	c.table.mu.Lock()
+	defer c.table.mu.Unlock()
+	rows := &jobRows{columns: names}
+	if job, ok := c.table.jobs[args[0].Value.(string)]; ok {
+		row := make([]driver.Value, len(names))
+		for i, name := range names {
+			row[i] = jobColumn(job, name)
+		}
+		rows.rows = append(rows.rows, row)
+	}
+	return rows, nil
+}
+
+func jobColumn(job *store.Job, name string) driver.Value {
+	switch name {
+	case "id":
+		return job.ID
+	case "user_id":
+		return int64(job.UserID)
+	case "agent_key_id":
+		return int64(job.AgentKeyID)
+	case "query":
+		return job.Query
+	case "format":
+		return job.Format
+	case "status":
+		return string(job.Status)
+	case "row_count":
+		return job.RowCount
+	case "bytes":
+		return job.Bytes
+	case "error":
+		return job.Error
+	case "created_at":
+		return job.CreatedAt
+	case "artifact_key":
+		return job.ArtifactKey
+	default:
+		return nil // unset timestamps and optional columns
+	}
+}
+
+// ExecContext applies job transitions:
+// UPDATE jobs SET status = ?[, column = ?|NOW()...] WHERE id = ? AND status IN (?...).
+func (c *jobsConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	set, ok := strings.CutPrefix(query, "UPDATE jobs SET ")
+	set, _, found := strings.Cut(set, " WHERE id = ? AND status IN (")
+	if !ok || !found {
+		return nil, fmt.Errorf("jobtable: unsupported statement %q", query)
+	}
+
+	values := make(map[string]driver.Value)
+	next := 0
+	for _, assignment := range strings.Split(set, ", ") {
+		column, value, _ := strings.Cut(assignment, " = ")
+		if value == "?" {
+			values[column] = args[next].Value
+			next++
+		}
+	}
+	id := args[next].Value.(string)
+
+	c.table.mu.Lock()
+	defer c.table.mu.Unlock()
+	job, ok := c.table.jobs[id]
+	if !ok {
+		return driver.RowsAffected(0), nil
+	}
+	allowed := false
+	for _, from := range args[next+1:] {
+		allowed = allowed || from.Value.(string) == string(job.Status)
+	}
+	if !allowed {
+		return driver.RowsAffected(0), nil
+	}
+
+	for column, v := range values {
+		switch column {
+		case "status":
+			job.Status = store.JobStatus(v.(string))
+		case "row_count":
+			job.RowCount = v.(int64)
+		case "bytes":
+			job.Bytes = v.(int64)
+		case "error":
+			job.Error = v.(string)
+		case "artifact_key":
+			job.ArtifactKey = v.(string)
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type jobRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *jobRows) Columns() []string { return r.columns }
+func (r *jobRows) Close() error      { return nil }
+
+func (r *jobRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
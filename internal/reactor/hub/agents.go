@@ -0,0 +1,192 @@
+package hub
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// AgentInfo describes a connected agent as reported by its hello message.
+type AgentInfo struct {
+	KeyID    int    `json:"agent_id"`
+	UserID   int    `json:"-"`
+	Driver   string `json:"driver,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	// Sources are the data sources the agent serves; the first is its default.
+	// Empty for agents that predate named sources.
+	Sources       []protocol.SourceInfo `json:"sources,omitempty"`
+	RemoteAddr    string                `json:"remote_addr"`
+	ConnectedAt   time.Time             `json:"connected_at"`
+	LastHeartbeat time.Time             `json:"last_heartbeat"`
+
+	Load *protocol.AgentLoad `json:"load,omitempty"`
+}
+
+// AgentConn is a live control connection to an agent, identified by its API key.
+// Writes are serialized because gorilla/websocket allows only one concurrent writer.
+type AgentConn struct {
+	KeyID  int
+	UserID int
+
+	conn *websocket.Conn
+	mu   sync.Mutex
+
+	info      AgentInfo
+	announced bool
+	infoMu    sync.RWMutex
+}
+
+// Send marshals v as JSON and writes it to the agent's control socket.
+func (a *AgentConn) Send(v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conn.WriteMessage(websocket.TextMessage, payload)
+}
+
+// Info returns a snapshot of the agent's metadata.
+func (a *AgentConn) Info() AgentInfo {
+	a.infoMu.RLock()
+	defer a.infoMu.RUnlock()
+	return a.info
+}
+
+// Announce records the metadata an agent reports about itself.
+func (a *AgentConn) Announce(driver, version, hostname string, sources []protocol.SourceInfo) {
+	a.infoMu.Lock()
+	defer a.infoMu.Unlock()
+	a.info.Driver = driver
+	a.info.Version = version
+	a.info.Hostname = hostname
+	a.info.Sources = sources
+	a.info.LastHeartbeat = time.Now()
+	a.announced = true
+}
+
+// Announced reports whether the agent sent its hello message. Agents from
+// before hello messages never do.
+func (a *AgentConn) Announced() bool {
+	a.infoMu.RLock()
+	defer a.infoMu.RUnlock()
+	return a.announced
+}
+
+// Heartbeat records the load reported in an agent heartbeat.
+func (a *AgentConn) Heartbeat(load *protocol.AgentLoad) {
+	a.infoMu.Lock()
+	defer a.infoMu.Unlock()
+	a.info.Load = load
+	a.info.LastHeartbeat = time.Now()
+}
+
+// Touch marks the agent as seen just now.
+func (a *AgentConn) Touch() {
+	a.infoMu.Lock()
+	defer a.infoMu.Unlock()
+	a.info.LastHeartbeat = time.Now()
+}
+
+// RegisterAgent records a control connection so jobs can be routed to it.
+// If the same key is already connected, the stale connection is closed.
+func (h *Hub) RegisterAgent(keyID, userID int, conn *websocket.Conn) *AgentConn {
+	now := time.Now()
+	agent := &AgentConn{
+		KeyID:  keyID,
+		UserID: userID,
+		conn:   conn,
+		info: AgentInfo{
+			KeyID:         keyID,
+			UserID:        userID,
+			RemoteAddr:    conn.RemoteAddr().String(),
+			ConnectedAt:   now,
+			LastHeartbeat: now,
+		},
+	}
+
+	h.agentsMu.Lock()
+	old, exists := h.agents[keyID]
+	h.agents[keyID] = agent
+	h.agentsMu.Unlock()
+
+	if exists {
+		slog.Warn("Agent reconnected, closing stale control connection", "key_id", keyID)
+		old.conn.Close()
+	}
+
+	h.broadcastAgentCount()
+	return agent
+}
+
+// UnregisterAgent removes the connection, unless it has already been replaced by a newer one.
+func (h *Hub) UnregisterAgent(agent *AgentConn) {
+	h.agentsMu.Lock()
+	current, ok := h.agents[agent.KeyID]
+	removed := ok && current == agent
+	if removed {
+		delete(h.agents, agent.KeyID)
+	}
+	h.agentsMu.Unlock()
+
+	if removed {
+		h.broadcastAgentCount()
+	}
+}
+
+// Agent returns the live control connection for the given API key, if any.
+func (h *Hub) Agent(keyID int) (*AgentConn, bool) {
+	h.agentsMu.RLock()
+	defer h.agentsMu.RUnlock()
+	agent, ok := h.agents[keyID]
+	return agent, ok
+}
+
+// AgentCount returns the number of connected agents.
+func (h *Hub) AgentCount() int {
+	h.agentsMu.RLock()
+	defer h.agentsMu.RUnlock()
+	return len(h.agents)
+}
+
+// runAgentReaper drops agents whose heartbeats have lapsed. Closing the connection
+// makes the control handler's read loop exit and unregister the agent, so a
+// half-open TCP connection cannot keep an agent "online" forever.
+func (h *Hub) runAgentReaper() {
+	ticker := time.NewTicker(protocol.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+
+		var lapsed []*AgentConn
+		h.agentsMu.RLock()
+		for _, agent := range h.agents {
+			if time.Since(agent.Info().LastHeartbeat) > protocol.HeartbeatTimeout {
+				lapsed = append(lapsed, agent)
+			}
+		}
+		h.agentsMu.RUnlock()
+
+		for _, agent := range lapsed {
+			slog.Warn("Agent heartbeat lapsed, marking offline", "key_id", agent.KeyID, "last_heartbeat", agent.Info().LastHeartbeat)
+			h.UnregisterAgent(agent)
+			agent.conn.Close()
+		}
+	}
+}
+
+func (h *Hub) broadcastAgentCount() {
+	h.Broadcast(DashboardUpdate{
+		Type:       "agent_update",
+		AgentCount: h.AgentCount(),
+	})
+}
@@ -10,27 +10,32 @@ import (
 )
 
 type DashboardUpdate struct {
-	Type       string `json:"type"` // "job_start", "progress", "job_complete", "agent_update", "metrics"
-	JobID      string `json:"job_id,omitempty"`
-	Rows       int    `json:"rows,omitempty"`
-	Status     string `json:"status,omitempty"`
-	AgentCount int    `json:"agent_count,omitempty"`
-	Throughput string `json:"throughput,omitempty"`
-	Load       string `json:"load,omitempty"`
-	Regions    int    `json:"regions,omitempty"`
-	Latency    string `json:"latency,omitempty"`
+	Type   string `json:"type"` // "job_start", "progress", "job_status", "job_complete", "job_failed", "job_cancelled", "agent_update", "metrics"
+	JobID  string `json:"job_id,omitempty"`
+	Rows   int    `json:"rows,omitempty"`
+	Status string `json:"status,omitempty"`
+	// DownloadURL links to the exported file of a completed job.
+	DownloadURL string `json:"download_url,omitempty"`
+	AgentCount  int    `json:"agent_count,omitempty"`
+	Throughput  string `json:"throughput,omitempty"`
+	Load        string `json:"load,omitempty"`
+	Regions     int    `json:"regions,omitempty"`
+	Latency     string `json:"latency,omitempty"`
 }
 
 type Hub struct {
 	dashboards  map[*websocket.Conn]bool
-	agentCount  int
 	lastMetrics DashboardUpdate
 	mu          sync.Mutex
+
+	agents   map[int]*AgentConn
+	agentsMu sync.RWMutex
 }
 
 func NewHub() *Hub {
 	h := &Hub{
 		dashboards: make(map[*websocket.Conn]bool),
+		agents:     make(map[int]*AgentConn),
 		lastMetrics: DashboardUpdate{
 			Type:       "metrics",
 			Throughput: "0.0 GB/s",
@@ -40,6 +45,7 @@ func NewHub() *Hub {
 		},
 	}
 	go h.runMetricsTicker()
+	go h.runAgentReaper()
 	return h
 }
 
@@ -74,31 +80,20 @@ func (h *Hub) Broadcast(update DashboardUpdate) {
 	}
 }
 
-func (h *Hub) UpdateAgentCount(delta int) {
-	h.mu.Lock()
-	h.agentCount += delta
-	count := h.agentCount
-	h.mu.Unlock()
-
-	h.Broadcast(DashboardUpdate{
-		Type:       "agent_update",
-		AgentCount: count,
-	})
-}
-
 func (h *Hub) runMetricsTicker() {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		<-ticker.C
+		agentCount := h.AgentCount()
 		h.mu.Lock()
 		// Simulate dynamic metrics
 		h.lastMetrics.Throughput = "1.2 GB/s"
 		h.lastMetrics.Load = "14.2%"
 		h.lastMetrics.Latency = "24ms"
 		h.lastMetrics.Regions = 3
-		h.lastMetrics.AgentCount = h.agentCount
+		h.lastMetrics.AgentCount = agentCount
 		update := h.lastMetrics
 		h.mu.Unlock()
 
@@ -30,7 +30,12 @@ func NewStore(dsn string) (*Store, error) {
 		return nil, fmt.Errorf("failed to ping db: %w", err)
 	}
 
-	return &Store{db: db}, nil
+	return New(db), nil
+}
+
+// New returns a store backed by an open database.
+func New(db *sql.DB) *Store {
+	return &Store{db: db}
 }
 
 func (s *Store) InitSchema() error {
@@ -53,6 +58,29 @@ func (s *Store) InitSchema() error {
 			last_used_at TIMESTAMP NULL,
 			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS jobs (
+			id VARCHAR(36) PRIMARY KEY,
+			user_id BIGINT NOT NULL,
+			agent_key_id BIGINT NOT NULL,
+			query TEXT NOT NULL,
+			format VARCHAR(16) NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			row_count BIGINT NOT NULL DEFAULT 0,
+			bytes BIGINT NOT NULL DEFAULT 0,
+			error TEXT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			dispatched_at TIMESTAMP NULL,
+			started_at TIMESTAMP NULL,
+			finished_at TIMESTAMP NULL,
+			artifact_key VARCHAR(255) NULL,
+			source VARCHAR(64) NULL,
+			INDEX idx_jobs_user (user_id, created_at),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		// Ensure artifact_key exists if the jobs table predates stored exports
+		`ALTER TABLE jobs ADD COLUMN artifact_key VARCHAR(255) NULL;`,
+		// Ensure source exists if the jobs table predates named agent sources
+		`ALTER TABLE jobs ADD COLUMN source VARCHAR(64) NULL;`,
 	}
 
 	for _, query := range queries {
@@ -191,6 +219,19 @@ func (s *Store) ListAPIKeys(userID int) ([]APIKey, error) {
 	return keys, nil
 }
 
+// GetAPIKey looks up a key by ID so callers can check ownership before acting on it.
+func (s *Store) GetAPIKey(keyID int) (*APIKey, error) {
+	var k APIKey
+	err := s.db.QueryRow("SELECT id, user_id, key_prefix, type, created_at FROM api_keys WHERE id = ?", keyID).
+		Scan(&k.ID, &k.UserID, &k.KeyPrefix, &k.Type, &k.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("api key not found")
+	} else if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
 func (s *Store) RevokeAPIKey(keyID int) error {
 	_, err := s.db.Exec("DELETE FROM api_keys WHERE id = ?", keyID)
 	return err
@@ -0,0 +1,268 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Job Methods
+
+type JobStatus string
+
+const (
+	JobPending    JobStatus = "PENDING"
+	JobDispatched JobStatus = "DISPATCHED"
+	JobQueued     JobStatus = "QUEUED"
+	JobRunning    JobStatus = "RUNNING"
+	JobCompleted  JobStatus = "COMPLETED"
+	JobFailed     JobStatus = "FAILED"
+	JobCancelled  JobStatus = "CANCELLED"
+	// JobTruncated means the data stream ended without a valid trailer, so the
+	// export may be missing rows.
+	JobTruncated JobStatus = "TRUNCATED"
+	// JobSpooled means the data stream was lost but the agent kept it on disk,
+	// and the job waits for the agent to upload it.
+	JobSpooled JobStatus = "SPOOLED"
+)
+
+// IsTerminal reports whether a job in this status can no longer change.
+func (s JobStatus) IsTerminal() bool {
+	return s == JobCompleted || s == JobFailed || s == JobCancelled || s == JobTruncated
+}
+
+var (
+	ErrJobNotFound       = errors.New("job not found")
+	ErrInvalidTransition = errors.New("invalid job status transition")
+)
+
+// jobTransitions lists, for each target status, the statuses a job may move from.
+// Terminal statuses never appear on the right-hand side, so a finished job stays finished.
+var jobTransitions = map[JobStatus][]JobStatus{
+	JobDispatched: {JobPending},
+	JobQueued:     {JobDispatched},
+	JobRunning:    {JobDispatched, JobQueued, JobSpooled},
+	JobSpooled:    {JobDispatched, JobQueued, JobRunning},
+	JobCompleted:  {JobRunning},
+	JobFailed:     {JobPending, JobDispatched, JobQueued, JobRunning, JobSpooled},
+	JobCancelled:  {JobPending, JobDispatched, JobQueued, JobRunning, JobSpooled},
+	JobTruncated:  {JobRunning},
+}
+
+// Job is an export request routed to a connected agent.
+type Job struct {
+	ID         string `json:"id"`
+	UserID     int    `json:"user_id"`
+	AgentKeyID int    `json:"agent_id"`
+	// Source is the agent data source the job runs against, empty for the
+	// agent's default source.
+	Source       string     `json:"source,omitempty"`
+	Query        string     `json:"query"`
+	Format       string     `json:"format"`
+	Status       JobStatus  `json:"status"`
+	RowCount     int64      `json:"row_count"`
+	Bytes        int64      `json:"bytes"`
+	Error        string     `json:"error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+
+	// ArtifactKey is the storage key of the exported file of a completed job.
+	ArtifactKey string `json:"-"`
+	// DownloadURL is filled in by the API from ArtifactKey; it is not stored.
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+const jobColumns = "id, user_id, agent_key_id, source, query, format, status, row_count, bytes, error, created_at, dispatched_at, started_at, finished_at, artifact_key"
+
+func (s *Store) CreateJob(job *Job) error {
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = time.Now()
+	}
+	_, err := s.db.Exec(
+		"INSERT INTO jobs (id, user_id, agent_key_id, source, query, format, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		job.ID, job.UserID, job.AgentKeyID, job.Source, job.Query, job.Format, job.Status, job.CreatedAt,
+	)
+	return err
+}
+
+func (s *Store) GetJob(jobID string) (*Job, error) {
+	row := s.db.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = ?", jobID)
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
+	}
+	return job, err
+}
+
+// JobFilter narrows ListJobs results. Zero values mean "no filter".
+type JobFilter struct {
+	UserID     int
+	Status     JobStatus
+	AgentKeyID int
+	From       time.Time
+	To         time.Time
+	Limit      int
+	Offset     int
+}
+
+// ListJobs returns one page of the user's jobs, newest first, along with the
+// total number of jobs matching the filter.
+func (s *Store) ListJobs(f JobFilter) ([]Job, int, error) {
+	where := []string{"user_id = ?"}
+	args := []interface{}{f.UserID}
+
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.AgentKeyID != 0 {
+		where = append(where, "agent_key_id = ?")
+		args = append(args, f.AgentKeyID)
+	}
+	if !f.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.To)
+	}
+	clause := strings.Join(where, " AND ")
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM jobs WHERE "+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := "SELECT " + jobColumns + " FROM jobs WHERE " + clause + " ORDER BY created_at DESC, id LIMIT ? OFFSET ?"
+	rows, err := s.db.Query(query, append(args, f.Limit, f.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, total, rows.Err()
+}
+
+// MarkJobDispatched records that the job was delivered to the agent's control socket.
+func (s *Store) MarkJobDispatched(jobID string) error {
+	return s.transitionJob(jobID, JobDispatched, "dispatched_at = NOW()")
+}
+
+// MarkJobQueued records that the agent accepted the job but is waiting for a free slot.
+func (s *Store) MarkJobQueued(jobID string) error {
+	return s.transitionJob(jobID, JobQueued, "")
+}
+
+// MarkJobRunning records that the agent opened the data stream for the job.
+func (s *Store) MarkJobRunning(jobID string) error {
+	return s.transitionJob(jobID, JobRunning, "started_at = NOW()")
+}
+
+// CompleteJob records a successful export with its final row and byte counts
+// and the storage key of the exported file.
+func (s *Store) CompleteJob(jobID string, rows, bytes int64, artifactKey string) error {
+	return s.transitionJob(jobID, JobCompleted, "row_count = ?, bytes = ?, artifact_key = ?, finished_at = NOW()", rows, bytes, artifactKey)
+}
+
+// FailJob records a failed export, keeping whatever progress was made before the failure.
+func (s *Store) FailJob(jobID string, rows, bytes int64, reason string) error {
+	return s.transitionJob(jobID, JobFailed, "row_count = ?, bytes = ?, error = ?, finished_at = NOW()", rows, bytes, reason)
+}
+
+// TruncateJob records an export whose data stream was cut off or failed verification.
+func (s *Store) TruncateJob(jobID string, rows, bytes int64, reason string) error {
+	return s.transitionJob(jobID, JobTruncated, "row_count = ?, bytes = ?, error = ?, finished_at = NOW()", rows, bytes, reason)
+}
+
+// MarkJobSpooled records that the data stream was lost and the job waits for
+// the agent to upload the stream it kept on disk.
+func (s *Store) MarkJobSpooled(jobID string, rows, bytes int64) error {
+	return s.transitionJob(jobID, JobSpooled, "row_count = ?, bytes = ?", rows, bytes)
+}
+
+// CancelJob records that the user stopped the job before it finished.
+func (s *Store) CancelJob(jobID string) error {
+	return s.transitionJob(jobID, JobCancelled, "finished_at = NOW()")
+}
+
+// transitionJob moves a job to the target status if its current status allows it.
+// set holds any extra column assignments for the transition and args their values.
+func (s *Store) transitionJob(jobID string, to JobStatus, set string, args ...interface{}) error {
+	from := jobTransitions[to]
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(from)), ", ")
+
+	if set != "" {
+		set = ", " + set
+	}
+	query := fmt.Sprintf("UPDATE jobs SET status = ?%s WHERE id = ? AND status IN (%s)", set, placeholders)
+
+	params := make([]interface{}, 0, len(args)+len(from)+2)
+	params = append(params, to)
+	params = append(params, args...)
+	params = append(params, jobID)
+	for _, status := range from {
+		params = append(params, status)
+	}
+
+	res, err := s.db.Exec(query, params...)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// Distinguish a missing job from one that is in the wrong state
+		job, err := s.GetJob(jobID)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, job.Status, to)
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row rowScanner) (*Job, error) {
+	var job Job
+	var source, errMsg, artifactKey sql.NullString
+	var dispatchedAt, startedAt, finishedAt sql.NullTime
+
+	err := row.Scan(
+		&job.ID, &job.UserID, &job.AgentKeyID, &source, &job.Query, &job.Format, &job.Status,
+		&job.RowCount, &job.Bytes, &errMsg,
+		&job.CreatedAt, &dispatchedAt, &startedAt, &finishedAt, &artifactKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Source = source.String
+	job.Error = errMsg.String
+	job.ArtifactKey = artifactKey.String
+	job.DispatchedAt = nullTimePtr(dispatchedAt)
+	job.StartedAt = nullTimePtr(startedAt)
+	job.FinishedAt = nullTimePtr(finishedAt)
+	return &job, nil
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
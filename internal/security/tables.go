@@ -0,0 +1,374 @@
+package security
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// ErrAmbiguousQuery is returned by QueryTables when the tables of a query
+// depend on server settings, e.g. whether backslashes escape quotes.
+var ErrAmbiguousQuery = errors.New("query reads different tables depending on server settings")
+
+// QueryTables returns the tables a SQL query for the given driver reads from,
+// as the server resolves their names: "table" or "schema.table", with
+// identifier quotes removed and unquoted identifiers folded to lower case for
+// PostgreSQL, as it does; MySQL keeps them as written. Derived tables and subqueries are searched as well, and table
+// functions are reported by name. MySQL's DUAL is not reported.
+//
+// It is a scanner rather than a parser: enough to check the tables of the
+// SELECT queries ValidateQuery accepts against an allowlist, erring on the side
+// of reporting too much. Comments and string literals follow the driver's
+// dialect; where they depend on server settings, the query is scanned under
+// each of them and ErrAmbiguousQuery returned unless they agree.
+func QueryTables(driverName, query string) ([]string, error) {
+	var tables []string
+	scanned := false
+	for _, d := range dialects(driverName) {
+		tokens, err := tokenizeSQL(query, d)
+		if err != nil {
+			continue // not a valid query under these settings
+		}
+		found := tokenTables(tokens)
+		if scanned && !slices.Equal(found, tables) {
+			return nil, ErrAmbiguousQuery
+		}
+		tables, scanned = found, true
+	}
+	if !scanned {
+		return nil, errUnterminated
+	}
+	return tables, nil
+}
+
+// tokenTables returns the tables read by a tokenized query, see QueryTables.
+func tokenTables(tokens []sqlToken) []string {
+	// scope is one level of parentheses
+	type scope struct {
+		function bool // arguments of a function call, where FROM is not a clause
+		inFrom   bool // inside the FROM clause of this level
+	}
+	stack := []scope{{}}
+	expectTable := false
+
+	var tables []string
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		top := &stack[len(stack)-1]
+		upper := strings.ToUpper(t.text)
+		keyword := t.word && !t.quoted
+
+		if top.function && keyword && (upper == "SELECT" || upper == "TABLE" || upper == "VALUES") {
+			// A subquery, e.g. ARRAY(SELECT ...) or f(x) IN (TABLE t), is not
+			// a function call. Whatever word came before the parenthesis, its
+			// tables are read.
+			top.function = false
+		}
+
+		switch {
+		case t.text == "(":
+			prev := sqlToken{}
+			if i > 0 {
+				prev = tokens[i-1]
+			}
+			isFunction := !expectTable && prev.isIdent() && (prev.quoted || !sqlKeywords[strings.ToUpper(prev.text)])
+			// Parentheses in a FROM clause can group tables, e.g. FROM (a, b)
+			stack = append(stack, scope{function: isFunction, inFrom: expectTable})
+
+		case t.text == ")":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			expectTable = false
+
+		case top.function:
+			// e.g. EXTRACT(YEAR FROM created_at) names no table
+
+		case keyword && (upper == "FROM" || upper == "JOIN" || strings.HasSuffix(upper, "_JOIN")):
+			// _JOIN covers MySQL's STRAIGHT_JOIN
+			top.inFrom = true
+			expectTable = true
+
+		case keyword && upper == "TABLE":
+			// TABLE name is short for SELECT * FROM name
+			expectTable = true
+
+		case t.text == ",":
+			expectTable = top.inFrom
+
+		case keyword && sqlClauseKeywords[upper]:
+			top.inFrom = false
+			expectTable = false
+
+		case expectTable && t.isIdent():
+			if keyword && (upper == "LATERAL" || upper == "ONLY") {
+				continue // modifiers before the table
+			}
+
+			name := t.text
+			for i+2 < len(tokens) && tokens[i+1].text == "." && tokens[i+2].isIdent() {
+				name += "." + tokens[i+2].text
+				i += 2
+			}
+			if t.quoted || !strings.EqualFold(name, "DUAL") {
+				tables = append(tables, name)
+			}
+			expectTable = false
+		}
+	}
+	return tables
+}
+
+// sqlKeywords are words that can precede a parenthesis without calling a function.
+var sqlKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "JOIN": true, "WHERE": true, "ON": true, "USING": true,
+	"IN": true, "EXISTS": true, "ANY": true, "ALL": true, "SOME": true, "AS": true,
+	"AND": true, "OR": true, "NOT": true, "LATERAL": true, "UNION": true, "EXCEPT": true,
+	"INTERSECT": true, "HAVING": true, "WITH": true, "DISTINCT": true, "ARRAY": true,
+	"CASE": true, "WHEN": true, "THEN": true, "ELSE": true, "BETWEEN": true, "LIKE": true,
+	"ILIKE": true, "IS": true,
+}
+
+// sqlClauseKeywords end a FROM clause.
+var sqlClauseKeywords = map[string]bool{
+	"SELECT": true, "WHERE": true, "GROUP": true, "ORDER": true, "HAVING": true,
+	"LIMIT": true, "OFFSET": true, "FETCH": true, "UNION": true, "EXCEPT": true,
+	"INTERSECT": true, "WINDOW": true, "FOR": true, "INTO": true, "LOCK": true,
+}
+
+type sqlToken struct {
+	text   string
+	word   bool // identifier or keyword
+	quoted bool // `quoted` or "quoted" identifier
+}
+
+func (t sqlToken) isIdent() bool {
+	return t.word || t.quoted
+}
+
+// sqlDialect is how a server splits a query into tokens.
+type sqlDialect struct {
+	hashComments       bool // # starts a comment (MySQL)
+	dashCommentSpace   bool // -- starts a comment only before whitespace (MySQL)
+	nestedComments     bool // /* */ comments nest (PostgreSQL)
+	execComments       bool // /*! */ comments are part of the query (MySQL)
+	backslashEscapes   bool // backslashes escape in '' strings
+	doubleQuoteStrings bool // "" quotes strings rather than identifiers (MySQL)
+	dollarQuotes       bool // $tag$ strings and E'' escape strings (PostgreSQL)
+	foldLower          bool // unquoted identifiers are folded to lower case (PostgreSQL)
+}
+
+// dialects returns the dialects of a driver under each server setting that
+// changes how queries are tokenized: sql_mode NO_BACKSLASH_ESCAPES and
+// ANSI_QUOTES and the server version for MySQL, standard_conforming_strings
+// for PostgreSQL. Unknown drivers get all of them.
+func dialects(driverName string) []sqlDialect {
+	var mysql, postgres []sqlDialect
+	for _, backslash := range []bool{true, false} {
+		postgres = append(postgres, sqlDialect{nestedComments: true, dollarQuotes: true, backslashEscapes: !backslash, foldLower: true})
+		for _, ansiQuotes := range []bool{false, true} {
+			for _, exec := range []bool{true, false} {
+				mysql = append(mysql, sqlDialect{
+					hashComments:       true,
+					dashCommentSpace:   true,
+					execComments:       exec,
+					backslashEscapes:   backslash,
+					doubleQuoteStrings: !ansiQuotes,
+				})
+			}
+		}
+	}
+
+	switch driverName {
+	case "mysql":
+		return mysql
+	case "postgres":
+		return postgres
+	default:
+		return append(mysql, postgres...)
+	}
+}
+
+// tokenizeSQL splits a query into words, quoted identifiers, string literals
+// and single punctuation characters, dropping comments. It fails on an
+// unterminated string, quoted identifier or block comment.
+func tokenizeSQL(query string, d sqlDialect) ([]sqlToken, error) {
+	var tokens []sqlToken
+	execComment := false // inside a /*! */ comment
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '-' && strings.HasPrefix(query[i:], "--") && (!d.dashCommentSpace || i+2 == len(query) || query[i+2] <= ' '),
+			c == '#' && d.hashComments:
+			end := strings.IndexByte(query[i:], '\n')
+			if end == -1 {
+				return tokens, nil
+			}
+			i += end + 1
+
+		case c == '/' && strings.HasPrefix(query[i:], "/*!") && d.execComments && !execComment:
+			// Executed, e.g. /*!50100 STRAIGHT_JOIN */
+			execComment = true
+			i += 3
+			for i < len(query) && query[i] >= '0' && query[i] <= '9' {
+				i++
+			}
+
+		case c == '*' && strings.HasPrefix(query[i:], "*/") && execComment:
+			execComment = false
+			i += 2
+
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := blockCommentEnd(query[i:], d.nestedComments)
+			if end == -1 {
+				return nil, errUnterminated
+			}
+			i += end
+
+		case c == '\'' || c == '"' && d.doubleQuoteStrings:
+			end := stringEnd(query[i:], d.backslashEscapes)
+			if end == -1 {
+				return nil, errUnterminated
+			}
+			tokens = append(tokens, sqlToken{text: query[i : i+end]})
+			i += end
+
+		case c == '`' || c == '"':
+			// Quoted identifier, with doubled quotes as escapes
+			var name strings.Builder
+			j := i + 1
+			for {
+				k := strings.IndexByte(query[j:], c)
+				if k == -1 {
+					return nil, errUnterminated
+				}
+				name.WriteString(query[j : j+k])
+				j += k + 1
+				if j < len(query) && query[j] == c {
+					name.WriteByte(c)
+					j++
+					continue
+				}
+				break
+			}
+			tokens = append(tokens, sqlToken{text: name.String(), quoted: true})
+			i = j
+
+		case c == '$' && d.dollarQuotes && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end == -1 {
+				return nil, errUnterminated
+			}
+			n := len(tag) + end + len(tag)
+			tokens = append(tokens, sqlToken{text: query[i : i+n]})
+			i += n
+
+		case isWordChar(c):
+			j := i
+			for j < len(query) && isWordChar(query[j]) {
+				j++
+			}
+			if d.dollarQuotes && j-i == 1 && (c == 'E' || c == 'e') && j < len(query) && query[j] == '\'' {
+				// E'...' escape string
+				end := stringEnd(query[j:], true)
+				if end == -1 {
+					return nil, errUnterminated
+				}
+				tokens = append(tokens, sqlToken{text: query[i : j+end]})
+				i = j + end
+				continue
+			}
+			word := query[i:j]
+			if d.foldLower {
+				word = lowerASCII(word)
+			}
+			tokens = append(tokens, sqlToken{text: word, word: true})
+			i = j
+
+		default:
+			tokens = append(tokens, sqlToken{text: query[i : i+1]})
+			i++
+		}
+	}
+	if execComment {
+		return nil, errUnterminated
+	}
+	return tokens, nil
+}
+
+var errUnterminated = errors.New("unterminated string, quoted identifier or comment")
+
+// stringEnd returns the length of the string literal s starts with, quoted
+// with s[0] and doubled quotes as escapes, or -1 if it is not terminated.
+func stringEnd(s string, backslashEscapes bool) int {
+	quote := s[0]
+	for j := 1; j < len(s); j++ {
+		switch {
+		case s[j] == '\\' && backslashEscapes:
+			j++
+		case s[j] == quote:
+			if j+1 < len(s) && s[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return -1
+}
+
+// blockCommentEnd returns the length of the /* */ comment s starts with, or
+// -1 if it is not terminated.
+func blockCommentEnd(s string, nested bool) int {
+	depth := 0
+	for j := 0; j+1 < len(s); j++ {
+		switch {
+		case s[j] == '/' && s[j+1] == '*' && (nested || depth == 0):
+			depth++
+			j++
+		case s[j] == '*' && s[j+1] == '/':
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return -1
+}
+
+// dollarTag returns the $tag$ that starts a PostgreSQL dollar-quoted string at
+// the start of s, or "" if there is none.
+func dollarTag(s string) string {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case c == '$':
+			return s[:j+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+		case c >= '0' && c <= '9' && j > 1:
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// lowerASCII folds ASCII letters to lower case like PostgreSQL does with
+// unquoted identifiers, leaving other characters alone.
+func lowerASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
@@ -0,0 +1,97 @@
+package security
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestQueryTables(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		query  string
+		want   []string
+	}{
+		{"simple", "mysql", "SELECT * FROM orders", []string{"orders"}},
+		{"qualified", "postgres", `SELECT * FROM sales."Orders" o`, []string{"sales.Orders"}},
+		{"postgres folds case", "postgres", `SELECT * FROM Sales.Orders, "Sales"."Orders"`, []string{"sales.orders", "Sales.Orders"}},
+		{"mysql keeps case", "mysql", "SELECT * FROM Sales.Orders, `Sales`.`Orders`", []string{"Sales.Orders", "Sales.Orders"}},
+		{"comma join", "mysql", "SELECT * FROM a, b WHERE a.id = b.id", []string{"a", "b"}},
+		{"joins", "mysql", "SELECT * FROM a LEFT JOIN b ON a.id = b.id NATURAL JOIN c", []string{"a", "b", "c"}},
+		{"straight join", "mysql", "SELECT * FROM allowed STRAIGHT_JOIN secret", []string{"allowed", "secret"}},
+		{"subquery", "postgres", "SELECT * FROM a WHERE id IN (SELECT id FROM b)", []string{"a", "b"}},
+		{"derived table", "mysql", "SELECT * FROM (SELECT * FROM a) t", []string{"a"}},
+		{"parenthesized tables", "mysql", "SELECT * FROM allowed, (secret)", []string{"allowed", "secret"}},
+		{"array subquery", "postgres", "SELECT ARRAY(SELECT row_to_json(s) FROM secret s) FROM allowed", []string{"secret", "allowed"}},
+		{"table statement", "postgres", "SELECT * FROM allowed WHERE id IN (TABLE secret)", []string{"allowed", "secret"}},
+		{"array table", "postgres", "SELECT ARRAY(TABLE secret) FROM allowed", []string{"secret", "allowed"}},
+		{"case table", "postgres", "SELECT CASE WHEN x THEN (TABLE secret) END FROM allowed", []string{"secret", "allowed"}},
+		{"between table", "postgres", "SELECT * FROM allowed WHERE id BETWEEN (TABLE secret) AND 10", []string{"allowed", "secret"}},
+		{"like table", "mysql", "SELECT * FROM allowed WHERE y LIKE (TABLE secret)", []string{"allowed", "secret"}},
+		{"function values", "postgres", "SELECT f((VALUES (1))), g((TABLE secret)) FROM allowed", []string{"secret", "allowed"}},
+		{"extract", "postgres", "SELECT EXTRACT(YEAR FROM created_at) FROM orders", []string{"orders"}},
+		{"dual", "mysql", "SELECT 1 FROM DUAL", nil},
+		{"cte", "postgres", "WITH x AS (SELECT * FROM secret) SELECT * FROM x", []string{"secret", "x"}},
+
+		{"mysql hash comment", "mysql", "SELECT * FROM allowed # , secret", []string{"allowed"}},
+		{"postgres hash operator", "postgres", "SELECT 1 # 1, s.* FROM secret s", []string{"secret"}},
+		{"mysql dash without space", "mysql", "SELECT 1--1, (SELECT x FROM secret)\nFROM allowed", []string{"secret", "allowed"}},
+		{"mysql dash comment", "mysql", "SELECT * FROM allowed -- , secret", []string{"allowed"}},
+		{"postgres standard string", "postgres", `SELECT 'a\', * FROM secret`, []string{"secret"}},
+		{"postgres escape string", "postgres", `SELECT E'\'', * FROM secret -- ' FROM allowed`, []string{"secret"}},
+		{"postgres dollar quotes", "postgres", "SELECT $x$ ' $x$, * FROM secret -- '", []string{"secret"}},
+		{"postgres nested comment", "postgres", "SELECT 1 /* /* */ ' */, * FROM secret -- '", []string{"secret"}},
+		{"doubled quotes", "postgres", `SELECT 'it''s', "a""b" FROM allowed`, []string{"allowed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := QueryTables(tt.driver, tt.query)
+			if err != nil {
+				t.Fatalf("QueryTables(%q): %v", tt.query, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("QueryTables(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryTablesAmbiguous(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		query  string
+	}{
+		// Depends on standard_conforming_strings
+		{"postgres backslash", "postgres", `SELECT '\', * FROM secret -- ' FROM allowed`},
+		// Depends on NO_BACKSLASH_ESCAPES
+		{"mysql backslash", "mysql", `SELECT '\', s.* FROM secret s -- ' FROM allowed`},
+		// Depends on ANSI_QUOTES
+		{"mysql double quotes", "mysql", `SELECT "\"", s.* FROM secret s -- " FROM allowed`},
+		// Depends on the server version
+		{"mysql executable comment", "mysql", "SELECT * FROM allowed /*!99999 , secret */"},
+		{"unknown driver", "", "SELECT 1 # 1, s.* FROM secret s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := QueryTables(tt.driver, tt.query)
+			if !errors.Is(err, ErrAmbiguousQuery) {
+				t.Errorf("QueryTables(%q) = %q, %v, want ErrAmbiguousQuery", tt.query, got, err)
+			}
+		})
+	}
+}
+
+func TestQueryTablesUnterminated(t *testing.T) {
+	for _, query := range []string{
+		"SELECT 'abc FROM secret",
+		"SELECT * FROM `secret",
+		"SELECT * FROM allowed /* secret",
+		"SELECT $$ FROM secret",
+	} {
+		if got, err := QueryTables("postgres", query); err == nil {
+			t.Errorf("QueryTables(%q) = %q, want an error", query, got)
+		}
+	}
+}
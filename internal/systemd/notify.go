@@ -0,0 +1,46 @@
+// Package systemd implements the parts of the systemd service notification
+// protocol the agent uses, so it can run as a Type=notify service.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends state to the service manager, e.g. "READY=1" or several
+// newline-separated assignments. It reports false without error when the
+// process was not started with a notification socket (NOTIFY_SOCKET unset).
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// A leading '@' names an abstract socket, which net translates
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often the service must send "WATCHDOG=1", or
+// zero if the watchdog is not enabled for this process. It is half the timeout
+// set with WatchdogSec, leaving room for a late tick.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,168 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// requestTimeout bounds every tunnel request; receiving ones are held for up
+// to PollWait.
+const requestTimeout = PollWait + 30*time.Second
+
+// Dial opens a tunnel at url, the Reactor's /agent/tunnel endpoint, and
+// returns the agent's end. header is sent with the request that opens it, e.g.
+// to authenticate the agent. client carries every request, so its transport
+// decides the proxy and TLS settings.
+func Dial(ctx context.Context, client *http.Client, url string, header http.Header) (*Conn, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("open tunnel: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var opened struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&opened); err != nil || opened.ID == "" {
+		return nil, fmt.Errorf("open tunnel: invalid response: %v", err)
+	}
+
+	conn := newConn("agent", url, resp.TLS)
+	closed, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-conn.done
+		cancel()
+	}()
+	c := &carrier{http: client, url: url + "/" + opened.ID, conn: conn, closed: closed}
+	go c.sendLoop()
+	go c.receiveLoop()
+	return conn, nil
+}
+
+// carrier carries the bytes of the agent's end of a tunnel.
+type carrier struct {
+	http   *http.Client
+	url    string
+	conn   *Conn
+	closed context.Context // done once the agent closed its end
+}
+
+// sendLoop sends the bytes written to the tunnel, one request at a time. Once
+// the tunnel is closed, it sends what is left and then closes the Reactor end.
+func (c *carrier) sendLoop() {
+	buf := make([]byte, maxChunk)
+	for {
+		n, err := c.conn.out.read(buf, nil, nil)
+		if err != nil {
+			if err != io.EOF {
+				return
+			}
+			if resp, err := c.do(http.MethodDelete, nil); err == nil {
+				resp.Body.Close()
+			}
+			return
+		}
+		resp, err := c.do(http.MethodPost, buf[:n])
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				err = fmt.Errorf("tunnel send: %s", resp.Status)
+			}
+		}
+		if err != nil {
+			c.conn.fail(err)
+			return
+		}
+	}
+}
+
+// receiveLoop polls for the bytes the Reactor wrote to the tunnel until either
+// end closes it.
+func (c *carrier) receiveLoop() {
+	for {
+		select {
+		case <-c.conn.done:
+			return
+		default:
+		}
+
+		resp, err := c.do(http.MethodGet, nil)
+		if err != nil {
+			c.conn.fail(err)
+			return
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			_, err = io.Copy(pipeWriter{c.conn}, resp.Body)
+		case http.StatusNoContent:
+		case http.StatusGone:
+			err = io.EOF
+		default:
+			err = fmt.Errorf("tunnel receive: %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			c.conn.fail(err)
+			return
+		}
+	}
+}
+
+// do makes a tunnel request. Receiving requests end when the tunnel is
+// closed; sending ones still deliver what was written before.
+func (c *carrier) do(method string, body []byte) (*http.Response, error) {
+	parent := context.Background()
+	if method == http.MethodGet {
+		parent = c.closed
+	}
+	ctx, cancel := context.WithTimeout(parent, requestTimeout)
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the request context once the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// pipeWriter writes received bytes to the agent's end of a tunnel.
+type pipeWriter struct {
+	conn *Conn
+}
+
+func (w pipeWriter) Write(b []byte) (int, error) {
+	return w.conn.in.write(b, nil, w.conn.done)
+}
@@ -0,0 +1,260 @@
+// Package tunnel carries a byte stream between an agent and the Reactor over
+// plain HTTP requests, for networks whose proxies or middleboxes block
+// WebSocket upgrades.
+//
+// The agent opens a tunnel with POST /agent/tunnel, which returns its ID. It
+// then sends bytes with POST /agent/tunnel/{id} and receives them with
+// GET /agent/tunnel/{id}, which the Reactor holds until it has bytes to send or
+// PollWait has passed. Each direction has a single request in flight, so bytes
+// arrive in order; a failed request breaks the tunnel. DELETE closes it.
+//
+// Both ends of a tunnel are a net.Conn. The Reactor serves its end like any
+// other connection, so the agent runs the usual WebSocket handshake and
+// protocol through the tunnel, unaware of the transport underneath.
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// PollWait is how long the Reactor holds a receiving request without
+	// bytes to send, below the idle timeout of most proxies.
+	PollWait = 25 * time.Second
+	// maxChunk bounds the bytes carried by one request.
+	maxChunk = 1 << 20
+	// bufferSize bounds the bytes buffered in each direction; writers wait
+	// for the other end to catch up beyond it.
+	bufferSize = 4 << 20
+)
+
+// Conn is one end of a tunnel.
+type Conn struct {
+	in  *pipe // bytes received, returned by Read
+	out *pipe // bytes written, carried to the other end
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+	onClose   func()
+
+	local, remote net.Addr
+	tlsState      *tls.ConnectionState
+}
+
+func newConn(local, remote string, tlsState *tls.ConnectionState) *Conn {
+	return &Conn{
+		in:       newPipe(bufferSize),
+		out:      newPipe(bufferSize),
+		done:     make(chan struct{}),
+		local:    addr(local),
+		remote:   addr(remote),
+		tlsState: tlsState,
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.in.read(b, &c.readDeadline, c.done)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.out.write(b, &c.writeDeadline, c.done)
+}
+
+// Close closes the tunnel. Bytes already written are still carried to the
+// other end, followed by EOF.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.in.close(net.ErrClosed)
+		c.out.close(io.EOF)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+// fail breaks the tunnel: Read returns err once the bytes received are read.
+func (c *Conn) fail(err error) {
+	c.in.close(err)
+	c.out.close(err)
+}
+
+// ConnectionState returns the TLS state of the HTTP request that opened the
+// tunnel, or nil if it was not made over TLS.
+func (c *Conn) ConnectionState() *tls.ConnectionState {
+	return c.tlsState
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.in.wake()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	c.out.wake()
+	return nil
+}
+
+// addr is the address of a tunnel end, e.g. the remote address of the request
+// that opened it.
+type addr string
+
+func (a addr) Network() string { return "tunnel" }
+func (a addr) String() string  { return string(a) }
+
+// pipe is a bounded byte buffer between a writer and a reader.
+type pipe struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	limit   int
+	err     error         // set once closed; reads drain the buffer first
+	changed chan struct{} // closed and replaced on every change
+}
+
+func newPipe(limit int) *pipe {
+	return &pipe{limit: limit, changed: make(chan struct{})}
+}
+
+// notify wakes every waiter. p.mu must be held.
+func (p *pipe) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// wake makes waiters check their deadline again.
+func (p *pipe) wake() {
+	p.mu.Lock()
+	p.notify()
+	p.mu.Unlock()
+}
+
+// read reads the bytes available, waiting for some until the deadline, if
+// any, or until done is closed.
+func (p *pipe) read(b []byte, d *deadline, done <-chan struct{}) (int, error) {
+	for {
+		p.mu.Lock()
+		if p.buf.Len() > 0 {
+			n, _ := p.buf.Read(b)
+			p.notify()
+			p.mu.Unlock()
+			return n, nil
+		}
+		if err := p.err; err != nil {
+			p.mu.Unlock()
+			return 0, err
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		if err := wait(changed, d, done); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// write buffers all of b, waiting for room until the deadline, if any, or
+// until done is closed.
+func (p *pipe) write(b []byte, d *deadline, done <-chan struct{}) (int, error) {
+	n := 0
+	for n < len(b) {
+		p.mu.Lock()
+		if p.err != nil {
+			p.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if room := p.limit - p.buf.Len(); room > 0 {
+			chunk := min(room, len(b)-n)
+			p.buf.Write(b[n : n+chunk])
+			n += chunk
+			p.notify()
+			p.mu.Unlock()
+			continue
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		if err := wait(changed, d, done); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// close stops writes; reads return err once the buffer is drained.
+func (p *pipe) close(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.notify()
+	}
+}
+
+// wait waits for changed to be closed, the deadline to pass or done to be closed.
+func wait(changed <-chan struct{}, d *deadline, done <-chan struct{}) error {
+	var timeout <-chan time.Time
+	if t := d.get(); !t.IsZero() {
+		left := time.Until(t)
+		if left <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(left)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-done:
+		return net.ErrClosed
+	}
+}
+
+// deadline is a net.Conn deadline; the zero value and a nil one mean none.
+type deadline struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	d.t = t
+	d.mu.Unlock()
+}
+
+func (d *deadline) get() time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t
+}
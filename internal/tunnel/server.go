@@ -0,0 +1,277 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// idleTimeout is how long a tunnel lives without requests from the agent,
+// which polls at least every PollWait.
+const idleTimeout = 2 * time.Minute
+
+// maxTunnelsPerKey bounds the tunnels open for one agent key. An agent needs
+// one for its control connection and one per running job or spool upload.
+const maxTunnelsPerKey = 64
+
+// Server is the Reactor end of the tunnels. It is a net.Listener that accepts
+// every tunnel opened through its HTTP handlers, to be served by an http.Server
+// with ConnContext set to this package's ConnContext.
+type Server struct {
+	accept chan *Conn
+	done   chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// session is the Reactor end of a tunnel, along with the key of the agent
+// that opened it and when the agent was last heard from.
+type session struct {
+	conn     *Conn
+	keyID    int
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+func (s *session) touch() {
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *session) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastSeen)
+}
+
+// NewServer creates a tunnel server and starts reaping abandoned tunnels.
+func NewServer() *Server {
+	s := &Server{
+		accept:   make(chan *Conn),
+		done:     make(chan struct{}),
+		sessions: make(map[string]*session),
+	}
+	go s.reapLoop()
+	return s
+}
+
+// Accept waits for the next tunnel to be opened.
+func (s *Server) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.accept:
+		return conn, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting tunnels and closes the open ones.
+func (s *Server) Close() error {
+	s.once.Do(func() { close(s.done) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		sess.conn.fail(io.EOF)
+		sess.conn.Close()
+		delete(s.sessions, id)
+	}
+	return nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return addr("tunnel")
+}
+
+// Open opens a tunnel for the agent key keyID and responds with its ID. The
+// caller authenticates the agent first.
+func (s *Server) Open(w http.ResponseWriter, r *http.Request, keyID int) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idBytes)
+
+	conn := newConn("tunnel/"+id, r.RemoteAddr, r.TLS)
+	sess := &session{conn: conn, keyID: keyID, lastSeen: time.Now()}
+	s.mu.Lock()
+	open := 0
+	for _, other := range s.sessions {
+		if other.keyID == keyID {
+			open++
+		}
+	}
+	if open >= maxTunnelsPerKey {
+		s.mu.Unlock()
+		slog.Warn("Too many open tunnels", "key_id", keyID, "open", open)
+		http.Error(w, "Too many open tunnels", http.StatusTooManyRequests)
+		return
+	}
+	s.sessions[id] = sess
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- conn:
+	case <-s.done:
+		s.remove(id)
+		http.Error(w, "Tunnel server closed", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		s.remove(id)
+		return
+	}
+
+	slog.Info("Tunnel Opened", "id", id, "key_id", keyID, "remote", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+// ServeHTTP carries the bytes of the tunnel named by the request's id path
+// value: POST sends, GET receives and DELETE closes it.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "Unknown tunnel", http.StatusGone)
+		return
+	}
+	sess.touch()
+
+	switch r.Method {
+	case http.MethodPost:
+		s.receive(w, r, sess)
+	case http.MethodGet:
+		s.send(w, r, id, sess)
+	case http.MethodDelete:
+		sess.conn.fail(io.EOF)
+		s.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// receive passes the bytes the agent sent to the Reactor end of the tunnel.
+func (s *Server) receive(w http.ResponseWriter, r *http.Request, sess *session) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxChunk))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if _, err := sess.conn.in.write(body, nil, r.Context().Done()); err != nil {
+		http.Error(w, "Tunnel closed", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// send responds with the bytes the Reactor wrote to the tunnel, waiting up to
+// PollWait for some.
+func (s *Server) send(w http.ResponseWriter, r *http.Request, id string, sess *session) {
+	d := &deadline{t: time.Now().Add(PollWait)}
+	buf := make([]byte, maxChunk)
+	n, err := sess.conn.out.read(buf, d, r.Context().Done())
+	switch {
+	case err == nil:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(buf[:n])
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		w.WriteHeader(http.StatusNoContent)
+	case r.Context().Err() != nil:
+	default:
+		// Closed, and everything written was delivered
+		s.remove(id)
+		http.Error(w, "Tunnel closed", http.StatusGone)
+	}
+	sess.touch()
+}
+
+func (s *Server) remove(id string) {
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	delete(s.sessions, id)
+	s.mu.Unlock()
+
+	if ok {
+		sess.conn.Close()
+		slog.Info("Tunnel Closed", "id", id)
+	}
+}
+
+// reapLoop closes tunnels the agent stopped polling, e.g. after losing its network.
+func (s *Server) reapLoop() {
+	ticker := time.NewTicker(PollWait)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.reap()
+	}
+}
+
+// reap closes the tunnels that have been idle for longer than idleTimeout.
+func (s *Server) reap() {
+	var idle []string
+	s.mu.Lock()
+	for id, sess := range s.sessions {
+		if sess.idle() > idleTimeout {
+			idle = append(idle, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range idle {
+		slog.Warn("Closing abandoned tunnel", "id", id)
+		if sess, ok := s.session(id); ok {
+			sess.conn.fail(io.EOF)
+		}
+		s.remove(id)
+	}
+}
+
+func (s *Server) session(id string) (*session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	return sess, ok
+}
+
+type tlsStateKey struct{}
+
+// ConnContext is the http.Server ConnContext for connections accepted from a
+// Server: requests made through a tunnel carry the TLS state of the request
+// that opened it, see TLSState.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if conn, ok := c.(*Conn); ok && conn.tlsState != nil {
+		return context.WithValue(ctx, tlsStateKey{}, conn.tlsState)
+	}
+	return ctx
+}
+
+// TLSState returns the TLS state of the request that opened the tunnel a
+// request was made through, or nil.
+func TLSState(ctx context.Context) *tls.ConnectionState {
+	state, _ := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	return state
+}
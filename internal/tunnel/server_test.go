@@ -0,0 +1,214 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serve runs s behind the Reactor's tunnel routes. The agent key ID is taken
+// from the X-Key-ID header, as the Reactor would after authenticating it.
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /agent/tunnel", func(w http.ResponseWriter, r *http.Request) {
+		keyID, _ := strconv.Atoi(r.Header.Get("X-Key-ID"))
+		s.Open(w, r, keyID)
+	})
+	mux.Handle("/agent/tunnel/{id}", s)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		s.Close()
+		srv.Close()
+	})
+	return srv.URL + "/agent/tunnel"
+}
+
+// accept returns the Reactor ends of the tunnels opened on s.
+func accept(s *Server) <-chan net.Conn {
+	conns := make(chan net.Conn, maxTunnelsPerKey+1)
+	go func() {
+		for {
+			conn, err := s.Accept()
+			if err != nil {
+				close(conns)
+				return
+			}
+			conns <- conn
+		}
+	}()
+	return conns
+}
+
+// open opens a tunnel without carrying it, like an agent that went away
+// right after, and returns the response status and the tunnel ID.
+func open(t *testing.T, url string, keyID int) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, nil)
+	req.Header.Set("X-Key-ID", strconv.Itoa(keyID))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var opened struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(resp.Body).Decode(&opened)
+	return resp.StatusCode, opened.ID
+}
+
+// waitClosed waits until s has no tunnels left.
+func waitClosed(t *testing.T, s *Server) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		n := len(s.sessions)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+	}
+	t.Fatal("tunnel was not removed")
+}
+
+func TestTunnelRoundTrip(t *testing.T) {
+	s := NewServer()
+	url := serve(t, s)
+	conns := accept(s)
+
+	// The Reactor end echoes until the agent closes the tunnel
+	echoed := make(chan error, 1)
+	go func() {
+		conn := <-conns
+		_, err := io.Copy(conn, conn)
+		conn.Close()
+		echoed <- err
+	}()
+
+	agent, err := Dial(t.Context(), http.DefaultClient, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More than one request carries in each direction
+	sent := bytes.Repeat([]byte("fluxquery"), 3*maxChunk/9)
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len(sent))
+		n, err := io.ReadFull(agent, buf)
+		if err != nil {
+			t.Errorf("read: %v", err)
+		}
+		received <- buf[:n]
+	}()
+	if _, err := agent.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, sent) {
+			t.Fatalf("echoed %d bytes that differ from the %d sent", len(got), len(sent))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the echo")
+	}
+
+	agent.Close()
+	select {
+	case <-echoed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reactor end was not closed with the agent end")
+	}
+	waitClosed(t, s)
+}
+
+func TestTunnelReactorClose(t *testing.T) {
+	s := NewServer()
+	url := serve(t, s)
+	conns := accept(s)
+
+	agent, err := Dial(t.Context(), http.DefaultClient, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	conn := <-conns
+	conn.Write([]byte("bye"))
+	conn.Close()
+
+	// Bytes written before closing still arrive, then EOF
+	got, err := io.ReadAll(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bye" {
+		t.Fatalf("got %q, want %q", got, "bye")
+	}
+	waitClosed(t, s)
+}
+
+func TestTunnelReap(t *testing.T) {
+	s := NewServer()
+	url := serve(t, s)
+	conns := accept(s)
+
+	status, id := open(t, url, 1)
+	if status != http.StatusCreated {
+		t.Fatalf("open: status %d", status)
+	}
+	conn := <-conns
+
+	// A tunnel still in use is kept
+	s.reap()
+	if _, ok := s.session(id); !ok {
+		t.Fatal("active tunnel was reaped")
+	}
+
+	sess, _ := s.session(id)
+	sess.mu.Lock()
+	sess.lastSeen = time.Now().Add(-idleTimeout - time.Second)
+	sess.mu.Unlock()
+	s.reap()
+
+	if _, ok := s.session(id); ok {
+		t.Fatal("abandoned tunnel was not reaped")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from a reaped tunnel succeeded")
+	}
+	resp, err := http.Get(url + "/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("reaped tunnel: status %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+}
+
+func TestTunnelLimitPerKey(t *testing.T) {
+	s := NewServer()
+	url := serve(t, s)
+	accept(s)
+
+	for i := 0; i < maxTunnelsPerKey; i++ {
+		if status, _ := open(t, url, 1); status != http.StatusCreated {
+			t.Fatalf("tunnel %d: status %d", i+1, status)
+		}
+	}
+	if status, _ := open(t, url, 1); status != http.StatusTooManyRequests {
+		t.Fatalf("tunnel over the limit: status %d, want %d", status, http.StatusTooManyRequests)
+	}
+	// Other keys are not affected
+	if status, _ := open(t, url, 2); status != http.StatusCreated {
+		t.Fatalf("tunnel of another key: status %d", status)
+	}
+}
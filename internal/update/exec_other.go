@@ -0,0 +1,14 @@
+//go:build !unix
+
+package update
+
+import "errors"
+
+// Supported reports whether the agent can update itself on this platform.
+// Elsewhere a process cannot be replaced in place, so updates are installed
+// with the installer instead.
+const Supported = false
+
+func execBinary(path string, args, env []string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package update
+
+import "syscall"
+
+// Supported reports whether the agent can update itself on this platform.
+const Supported = true
+
+// execBinary replaces the running process, keeping its PID so a service
+// manager keeps tracking it.
+func execBinary(path string, args, env []string) error {
+	return syscall.Exec(path, args, env)
+}
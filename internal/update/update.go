@@ -0,0 +1,398 @@
+// Package update lets the agent replace its own binary with a newer release.
+//
+// A release publishes three assets per platform: the binary (e.g.
+// fluxquery-agent-linux-amd64), its SHA-256 checksum in sha256sum format
+// (.sha256) and the base64 ed25519 signature of SignedMessage (.sig). The
+// signed message names the version and the asset along with the checksum, so a
+// signature cannot be replayed for another release or platform.
+//
+// Updating takes two steps. Stage downloads and verifies the release next to
+// the installed binary, as <binary>.new, and records it in <binary>.update.
+// Once the agent has drained, Release.Exec runs the staged binary in its place,
+// on trial: when it reaches the Reactor it commits by renaming itself over the
+// installed binary. Until then the installed binary is still the previous
+// version. If the trial fails it is started again, by the trial rolling back or
+// by the service manager after a crash, and discards the release.
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultURL is where release assets are downloaded from by default.
+const DefaultURL = "https://github.com/lexiumindustries/fluxquery-backend/releases/download/{version}/{asset}"
+
+// TrialTimeout is how long a release on trial has to reach the Reactor before
+// it rolls back.
+const TrialTimeout = 2 * time.Minute
+
+const (
+	// envTrial is set for a release on trial, to the path of the installed binary.
+	envTrial = "FLUXQUERY_AGENT_TRIAL"
+	// maxBinarySize bounds the download of a release binary.
+	maxBinarySize = 256 << 20
+)
+
+// Config configures self-updates. They are disabled without a public key.
+type Config struct {
+	// URL is the location of the release assets, with {version} and {asset}
+	// replaced by the advertised version and the asset name.
+	URL string `yaml:"url"`
+	// PublicKey is the base64 ed25519 key releases are signed with.
+	PublicKey string `yaml:"public_key"`
+	// Proxy picks the HTTP proxy for downloads; nil uses the environment.
+	Proxy func(*http.Request) (*url.URL, error) `yaml:"-"`
+}
+
+// AssetName is the name of the release binary for a platform.
+func AssetName(goos, goarch string) string {
+	name := "fluxquery-agent-" + goos + "-" + goarch
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// SignedMessage is what a release signature covers: the version, the asset
+// and its hex SHA-256 checksum.
+func SignedMessage(version, asset, checksum string) []byte {
+	return fmt.Appendf(nil, "fluxquery-agent %s %s sha256:%s\n", version, asset, checksum)
+}
+
+// state is the content of <binary>.update while a release is staged or after
+// its trial failed.
+type state struct {
+	Version  string `json:"version"`  // the staged release
+	Previous string `json:"previous"` // the version it replaces
+	Failed   bool   `json:"failed,omitempty"`
+}
+
+// Updater stages releases for the running agent.
+type Updater struct {
+	url     string
+	key     ed25519.PublicKey
+	version string // running version
+	path    string // installed binary
+	client  *http.Client
+	onTrial bool // started by Release.Exec
+
+	failed string // release whose trial failed, not staged again
+}
+
+// New creates an updater for the running agent version. The installed binary
+// is the running executable, or the one it replaces while on trial.
+func New(cfg Config, version string) (*Updater, error) {
+	key, err := base64.StdEncoding.DecodeString(cfg.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("public_key must be a base64 ed25519 public key")
+	}
+	if cfg.URL == "" {
+		cfg.URL = DefaultURL
+	}
+
+	path := os.Getenv(envTrial)
+	onTrial := path != ""
+	if !onTrial {
+		if path, err = os.Executable(); err != nil {
+			return nil, err
+		}
+		if path, err = filepath.EvalSymlinks(path); err != nil {
+			return nil, err
+		}
+	}
+	// A rollback must not look like a trial
+	os.Unsetenv(envTrial)
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+	if cfg.Proxy != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = cfg.Proxy
+		client.Transport = transport
+	}
+
+	return &Updater{
+		url:     cfg.URL,
+		key:     ed25519.PublicKey(key),
+		version: version,
+		path:    path,
+		client:  client,
+		onTrial: onTrial,
+	}, nil
+}
+
+func (u *Updater) stagedPath() string { return u.path + ".new" }
+func (u *Updater) statePath() string  { return u.path + ".update" }
+
+// Start settles the update left by a previous run. It returns the trial if
+// this process is a staged release on trial, or nil. A release found staged
+// otherwise failed its trial, so it is discarded and not staged again.
+func (u *Updater) Start() *Trial {
+	st, err := u.readState()
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Ignoring unreadable update state", "path", u.statePath(), "error", err)
+		}
+		return nil
+	}
+
+	switch {
+	case st.Failed:
+		u.failed = st.Version
+	case st.Version == u.version && u.onTrial:
+		slog.Info("Agent update on trial", "version", u.version, "previous", st.Previous)
+		return &Trial{u: u, previous: st.Previous}
+	case st.Version == u.version:
+		// Installed after all, e.g. the commit could not clean up
+		os.Remove(u.statePath())
+	default:
+		slog.Error("Agent update failed to start, rolled back", "version", st.Version, "running", u.version)
+		u.discard(st)
+	}
+	return nil
+}
+
+// Wants reports whether version should be staged: a release newer than the
+// running one whose trial has not failed before. Development builds, whose
+// version is not a release, never update.
+func (u *Updater) Wants(version string) bool {
+	return version != u.failed && newer(version, u.version)
+}
+
+// Stage downloads the release, verifies its signature and checksum, and checks
+// that it runs here, before recording it for Exec.
+func (u *Updater) Stage(ctx context.Context, version string) (*Release, error) {
+	if !u.Wants(version) {
+		return nil, fmt.Errorf("release %s is not an update for %s", version, u.version)
+	}
+	asset := AssetName(runtime.GOOS, runtime.GOARCH)
+
+	sums, err := u.fetch(ctx, version, asset+".sha256")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := u.fetch(ctx, version, asset+".sig")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(sums))
+	if len(fields) == 0 || len(fields[0]) != 2*sha256.Size {
+		return nil, fmt.Errorf("invalid checksum file %s.sha256", asset)
+	}
+	checksum := strings.ToLower(fields[0])
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(u.key, SignedMessage(version, asset, checksum), signature) {
+		return nil, fmt.Errorf("invalid signature for %s %s", asset, version)
+	}
+
+	if err := u.download(ctx, version, asset, checksum); err != nil {
+		os.Remove(u.stagedPath())
+		return nil, err
+	}
+
+	// Fails early on a binary that cannot run here, e.g. a missing library
+	out, err := exec.CommandContext(ctx, u.stagedPath(), "-version").Output()
+	if err != nil || !strings.Contains(string(out), version) {
+		os.Remove(u.stagedPath())
+		return nil, fmt.Errorf("staged release does not run: %q: %v", strings.TrimSpace(string(out)), err)
+	}
+
+	if err := u.writeState(state{Version: version, Previous: u.version}); err != nil {
+		os.Remove(u.stagedPath())
+		return nil, err
+	}
+	return &Release{u: u, Version: version}, nil
+}
+
+// fetch downloads a small release asset, such as a checksum or signature.
+func (u *Updater) fetch(ctx context.Context, version, asset string) ([]byte, error) {
+	body, err := u.get(ctx, version, asset)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(io.LimitReader(body, 4<<10))
+}
+
+// download writes the release binary to the staged path, with the mode of the
+// installed one, and checks it against checksum.
+func (u *Updater) download(ctx context.Context, version, asset, checksum string) error {
+	body, err := u.get(ctx, version, asset)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	mode := fs.FileMode(0o755)
+	if info, err := os.Stat(u.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.OpenFile(u.stagedPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(body, maxBinarySize+1))
+	if err != nil {
+		return fmt.Errorf("download %s: %w", asset, err)
+	}
+	if n > maxBinarySize {
+		return fmt.Errorf("download %s: larger than %d bytes", asset, maxBinarySize)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != checksum {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", asset, got, checksum)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (u *Updater) get(ctx context.Context, version, asset string) (io.ReadCloser, error) {
+	r := strings.NewReplacer("{version}", url.PathEscape(version), "{asset}", url.PathEscape(asset))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.Replace(u.url), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download %s: %s", asset, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (u *Updater) readState() (state, error) {
+	var st state
+	data, err := os.ReadFile(u.statePath())
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+func (u *Updater) writeState(st state) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(u.statePath(), data, 0o644)
+}
+
+// Abandon discards a staged release without marking it failed, for an agent
+// stopped before the release could prove itself. The next start runs the
+// installed binary, which may stage the release again.
+func (u *Updater) Abandon() {
+	os.Remove(u.stagedPath())
+	os.Remove(u.statePath())
+}
+
+// discard removes a staged release and remembers that its trial failed.
+func (u *Updater) discard(st state) {
+	os.Remove(u.stagedPath())
+	st.Failed = true
+	if err := u.writeState(st); err != nil {
+		slog.Warn("Failed to record failed agent update", "error", err)
+	}
+	u.failed = st.Version
+}
+
+// Release is a verified release staged next to the installed binary.
+type Release struct {
+	u       *Updater
+	Version string
+}
+
+// Exec replaces the running process with the release, on trial. It only
+// returns on failure, after discarding the release.
+func (r *Release) Exec() error {
+	env := append(os.Environ(), envTrial+"="+r.u.path)
+	err := execBinary(r.u.stagedPath(), os.Args, env)
+	r.u.discard(state{Version: r.Version, Previous: r.u.version})
+	return err
+}
+
+// Trial is the running process as a staged release that has yet to prove
+// it works.
+type Trial struct {
+	u        *Updater
+	previous string
+}
+
+// Commit installs the release on trial by renaming it over the previous
+// binary, which is atomic.
+func (t *Trial) Commit() error {
+	if err := os.Rename(t.u.stagedPath(), t.u.path); err != nil {
+		return err
+	}
+	os.Remove(t.u.statePath())
+	slog.Info("Agent update installed", "version", t.u.version, "previous", t.previous)
+	return nil
+}
+
+// Rollback discards the release on trial and replaces the running process
+// with the previous binary. It only returns on failure.
+func (t *Trial) Rollback() error {
+	slog.Warn("Rolling back agent update", "version", t.u.version, "previous", t.previous)
+	t.u.discard(state{Version: t.u.version, Previous: t.previous})
+	return execBinary(t.u.path, os.Args, os.Environ())
+}
+
+// newer reports whether version a is a release newer than b. Versions are
+// vMAJOR.MINOR.PATCH; anything else is never newer nor older.
+func newer(a, b string) bool {
+	va, ok := parseVersion(a)
+	if !ok {
+		return false
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return false
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			return va[i] > vb[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var parsed [3]int
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if len(parts) != len(parsed) {
+		return parsed, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
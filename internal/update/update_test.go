@@ -0,0 +1,211 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// release is a fake release server: it serves assets by name and records
+// which ones were downloaded.
+type release struct {
+	mu         sync.Mutex
+	assets     map[string][]byte
+	downloaded map[string]bool
+}
+
+func (rel *release) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rel.mu.Lock()
+	defer rel.mu.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	data, ok := rel.assets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rel.downloaded[name] = true
+	w.Write(data)
+}
+
+func (rel *release) fetched(name string) bool {
+	rel.mu.Lock()
+	defer rel.mu.Unlock()
+	return rel.downloaded[name]
+}
+
+// signedRelease publishes binary as version, with a checksum and a signature
+// made with key.
+func signedRelease(version string, binary []byte, key ed25519.PrivateKey) *release {
+	asset := AssetName(runtime.GOOS, runtime.GOARCH)
+	sum := sha256.Sum256(binary)
+	checksum := hex.EncodeToString(sum[:])
+	sig := ed25519.Sign(key, SignedMessage(version, asset, checksum))
+	return &release{
+		assets: map[string][]byte{
+			version + "/" + asset:             binary,
+			version + "/" + asset + ".sha256": []byte(checksum + "  " + asset + "\n"),
+			version + "/" + asset + ".sig":    []byte(base64.StdEncoding.EncodeToString(sig) + "\n"),
+		},
+		downloaded: make(map[string]bool),
+	}
+}
+
+// newTestUpdater returns an updater for v1.0.0 installed in a temporary
+// directory, downloading from rel and trusting pub.
+func newTestUpdater(t *testing.T, rel *release, pub ed25519.PublicKey) *Updater {
+	t.Helper()
+	srv := httptest.NewServer(rel)
+	t.Cleanup(srv.Close)
+	path := filepath.Join(t.TempDir(), "fluxquery-agent")
+	if err := os.WriteFile(path, []byte("installed"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return &Updater{
+		url:     srv.URL + "/{version}/{asset}",
+		key:     pub,
+		version: "v1.0.0",
+		path:    path,
+		client:  srv.Client(),
+	}
+}
+
+func TestStageRejects(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	asset := AssetName(runtime.GOOS, runtime.GOARCH)
+	binary := []byte("#!/bin/sh\necho v1.1.0\n")
+
+	tests := []struct {
+		name   string
+		setup  func(rel *release)
+		errMsg string
+	}{
+		{
+			name: "signed by another key",
+			setup: func(rel *release) {
+				rel.assets = signedRelease("v1.1.0", binary, otherKey).assets
+			},
+			errMsg: "invalid signature",
+		},
+		{
+			name: "signature of another version",
+			setup: func(rel *release) {
+				old := signedRelease("v1.0.1", binary, key)
+				rel.assets["v1.1.0/"+asset+".sig"] = old.assets["v1.0.1/"+asset+".sig"]
+			},
+			errMsg: "invalid signature",
+		},
+		{
+			name: "signature of another asset",
+			setup: func(rel *release) {
+				sum := sha256.Sum256(binary)
+				sig := ed25519.Sign(key, SignedMessage("v1.1.0", AssetName("plan9", "386"), hex.EncodeToString(sum[:])))
+				rel.assets["v1.1.0/"+asset+".sig"] = []byte(base64.StdEncoding.EncodeToString(sig))
+			},
+			errMsg: "invalid signature",
+		},
+		{
+			name: "signature not base64",
+			setup: func(rel *release) {
+				rel.assets["v1.1.0/"+asset+".sig"] = []byte("not a signature")
+			},
+			errMsg: "invalid signature",
+		},
+		{
+			name: "missing signature",
+			setup: func(rel *release) {
+				delete(rel.assets, "v1.1.0/"+asset+".sig")
+			},
+			errMsg: "404",
+		},
+		{
+			name: "checksum replaced along with the binary",
+			setup: func(rel *release) {
+				tampered := []byte("#!/bin/sh\necho tampered v1.1.0\n")
+				sum := sha256.Sum256(tampered)
+				rel.assets["v1.1.0/"+asset] = tampered
+				rel.assets["v1.1.0/"+asset+".sha256"] = []byte(hex.EncodeToString(sum[:]) + "  " + asset)
+			},
+			errMsg: "invalid signature",
+		},
+		{
+			name: "invalid checksum file",
+			setup: func(rel *release) {
+				rel.assets["v1.1.0/"+asset+".sha256"] = []byte("deadbeef  " + asset)
+			},
+			errMsg: "invalid checksum file",
+		},
+		{
+			name: "binary does not match checksum",
+			setup: func(rel *release) {
+				rel.assets["v1.1.0/"+asset] = []byte("#!/bin/sh\necho tampered v1.1.0\n")
+			},
+			errMsg: "checksum mismatch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rel := signedRelease("v1.1.0", binary, key)
+			tt.setup(rel)
+			u := newTestUpdater(t, rel, pub)
+
+			r, err := u.Stage(context.Background(), "v1.1.0")
+			if err == nil {
+				t.Fatalf("staged %s", r.Version)
+			}
+			if !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("error %q, want %q", err, tt.errMsg)
+			}
+			if tt.errMsg == "invalid signature" && rel.fetched("v1.1.0/"+asset) {
+				t.Error("binary downloaded despite an invalid signature")
+			}
+			if _, err := os.Stat(u.stagedPath()); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("staged binary left behind: %v", err)
+			}
+			if _, err := os.Stat(u.statePath()); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("update state written: %v", err)
+			}
+		})
+	}
+}
+
+func TestStage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake release binary is a shell script")
+	}
+	pub, key, _ := ed25519.GenerateKey(nil)
+	u := newTestUpdater(t, signedRelease("v1.1.0", []byte("#!/bin/sh\necho v1.1.0\n"), key), pub)
+
+	r, err := u.Stage(context.Background(), "v1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != "v1.1.0" {
+		t.Errorf("staged %s", r.Version)
+	}
+	st, err := u.readState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st != (state{Version: "v1.1.0", Previous: "v1.0.0"}) {
+		t.Errorf("state %+v", st)
+	}
+
+	// Releases that are not newer are never staged
+	if _, err := u.Stage(context.Background(), "v1.0.0"); err == nil {
+		t.Error("staged the running version")
+	}
+}
@@ -180,13 +180,7 @@ func (p *Pool) processJob(workerID int, job *ExportJob) {
 
 func (p *Pool) executeExport(job *ExportJob) error {
 	// Setup Pipeline
-	ext := job.Format
-	if ext == "" {
-		ext = "csv"
-	}
-	if ext == "excel" {
-		ext = "xlsx"
-	}
+	ext := exporter.Extension(job.Format)
 
 	if p.useGzip {
 		job.S3Key = fmt.Sprintf("exports/%s.%s.gz", job.ID, ext)
@@ -206,17 +200,7 @@ func (p *Pool) executeExport(job *ExportJob) error {
 	}
 
 	// Choose Encoder
-	var encoder exporter.RowEncoder
-	switch job.Format {
-	case "json":
-		encoder = exporter.NewJSONEncoder(finalWriter)
-	case "excel":
-		encoder = exporter.NewExcelEncoder(finalWriter)
-	case "pdf":
-		encoder = exporter.NewPDFEncoder(finalWriter)
-	default:
-		encoder = exporter.NewCSVEncoder(finalWriter)
-	}
+	encoder := exporter.NewEncoder(job.Format, finalWriter)
 
 	// Prepare MySQL Streamer
 	mysqlStreamer := exporter.NewMySQLStreamer(p.db)
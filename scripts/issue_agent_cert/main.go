@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"mysql-exporter/internal/protocol"
+)
+
+// Issues the client certificates agents present to a Reactor configured with
+// AGENT_CLIENT_CA_FILE. Each certificate is bound to one agent key.
+//
+//	go run ./scripts/issue_agent_cert -init-ca
+//	go run ./scripts/issue_agent_cert -key-id 42
+func main() {
+	initCA := flag.Bool("init-ca", false, "Create a new agent CA (agent-ca.crt, agent-ca.key)")
+	keyID := flag.Int("key-id", 0, "ID of the agent key to issue a certificate for")
+	caCert := flag.String("ca-cert", "agent-ca.crt", "Agent CA certificate")
+	caKey := flag.String("ca-key", "agent-ca.key", "Agent CA private key")
+	days := flag.Int("days", 365, "Validity of the agent certificate in days")
+	flag.Parse()
+
+	var err error
+	switch {
+	case *initCA:
+		err = createCA(*caCert, *caKey)
+	case *keyID > 0:
+		err = issue(*caCert, *caKey, *keyID, time.Duration(*days)*24*time.Hour)
+	default:
+		fmt.Println("Usage: issue_agent_cert -init-ca | -key-id <id> [-ca-cert agent-ca.crt] [-ca-key agent-ca.key] [-days 365]")
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func createCA(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "FluxQuery Agent CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyPair(certPath, keyPath, der, key); err != nil {
+		return err
+	}
+	fmt.Printf("Created %s and %s\n", certPath, keyPath)
+	fmt.Println("Set AGENT_CLIENT_CA_FILE to the certificate on the Reactor; keep the key offline.")
+	return nil
+}
+
+func issue(caCertPath, caKeyPath string, keyID int, validity time.Duration) error {
+	ca, err := tls.LoadX509KeyPair(caCertPath, caKeyPath)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	name := protocol.AgentCertName(keyID)
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyPair(name+".crt", name+".key", der, key); err != nil {
+		return err
+	}
+	fmt.Printf("Issued %s.crt and %s.key for agent key %d, valid until %s\n", name, name, keyID, template.NotAfter.Format(time.DateOnly))
+	fmt.Println("Set tls.cert_file and tls.key_file in the agent configuration.")
+	return nil
+}
+
+func writeKeyPair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+func serialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
@@ -2,10 +2,15 @@
 
 # FluxQuery Agent Release Script
 # This script cross-compiles the agent for major platforms.
+# Usage: release_agent.sh <version>, e.g. v2.0.5 (default: the latest tag).
+# semantic-release runs it with the tag of the release it is creating, which
+# is the version agents report and download their updates from.
+# With AGENT_SIGNING_KEY set, it also writes the checksum and signature
+# agents verify before updating themselves (see scripts/sign_release).
 
 set -e
 
-VERSION="v2.0.4"
+VERSION="${1:-$(git describe --tags --abbrev=0)}"
 BIN_NAME="fluxquery-agent"
 BUILD_DIR="./bin"
 CMD_PATH="./cmd/agent/main.go"
@@ -30,4 +35,11 @@ GOOS=darwin GOARCH=arm64 go build -ldflags="-s -w -X main.version=$VERSION" -o $
 echo "Compiling for macOS (x64)..."
 GOOS=darwin GOARCH=amd64 go build -ldflags="-s -w -X main.version=$VERSION" -o $BUILD_DIR/${BIN_NAME}-darwin-amd64 $CMD_PATH
 
+if [ -n "$AGENT_SIGNING_KEY" ]; then
+  echo "Signing binaries..."
+  go run ./scripts/sign_release -version $VERSION $BUILD_DIR/${BIN_NAME}-*
+else
+  echo "AGENT_SIGNING_KEY not set, skipping signatures: agents will not self-update to this release"
+fi
+
 echo "Release complete. Binaries located in $BUILD_DIR"
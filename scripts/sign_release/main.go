@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mysql-exporter/internal/update"
+)
+
+// Writes the .sha256 and .sig assets the agent verifies before updating itself.
+//
+//	go run ./scripts/sign_release -keygen
+//	AGENT_SIGNING_KEY=... go run ./scripts/sign_release -version v2.0.5 bin/fluxquery-agent-*
+func main() {
+	keygen := flag.Bool("keygen", false, "Generate a new signing key pair")
+	version := flag.String("version", "", "Release version the binaries are signed for")
+	flag.Parse()
+
+	if *keygen {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("=== New Release Signing Key ===")
+		fmt.Println("Private (AGENT_SIGNING_KEY): " + base64.StdEncoding.EncodeToString(priv.Seed()))
+		fmt.Println("Public  (agent update.public_key): " + base64.StdEncoding.EncodeToString(pub))
+		fmt.Println("===============================")
+		fmt.Println("Keep the private key offline or in the release pipeline's secret store only.")
+		return
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(os.Getenv("AGENT_SIGNING_KEY"))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		fmt.Println("Error: AGENT_SIGNING_KEY must be a base64 ed25519 seed (see -keygen)")
+		os.Exit(1)
+	}
+	if *version == "" || flag.NArg() == 0 {
+		fmt.Println("Usage: sign_release -version <version> <binary>...")
+		os.Exit(2)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+
+	for _, path := range flag.Args() {
+		// Globs like bin/* also match the assets of a previous run
+		if strings.HasSuffix(path, ".sha256") || strings.HasSuffix(path, ".sig") {
+			continue
+		}
+		if err := sign(key, *version, path); err != nil {
+			fmt.Printf("Error: %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signed %s\n", path)
+	}
+}
+
+func sign(key ed25519.PrivateKey, version, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	asset := filepath.Base(path)
+
+	if err := os.WriteFile(path+".sha256", []byte(checksum+"  "+asset+"\n"), 0o644); err != nil {
+		return err
+	}
+	sig := ed25519.Sign(key, update.SignedMessage(version, asset, checksum))
+	return os.WriteFile(path+".sig", []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0o644)
+}